@@ -0,0 +1,175 @@
+// Package audit records security-relevant events in the audit_events table.
+// Events are append-only and outlive the accounts they describe.
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"password-manager/models"
+)
+
+// Actions. The part before the dot groups related events.
+const (
+	ActionRegistered        = "account.registered"
+	ActionDeletionScheduled = "account.deletion_scheduled"
+	ActionDeletionCancelled = "account.deletion_cancelled"
+	ActionAccountPurged     = "account.purged"
+
+	ActionAuthFailed      = "auth.failed"
+	ActionSessionsRevoked = "auth.sessions_revoked"
+	ActionDeviceRevoked   = "device.revoked"
+
+	ActionTokenCreated = "access_token.created"
+	ActionTokenDeleted = "access_token.deleted"
+
+	ActionVaultSetup       = "vault.setup"
+	ActionVaultAuthHashSet = "vault.auth_hash_set"
+	ActionVaultAuthFailed  = "vault.auth_failed"
+
+	ActionEntryCreated = "entry.created"
+	ActionEntryUpdated = "entry.updated"
+	ActionEntryDeleted = "entry.deleted"
+
+	ActionTOTPEnabled              = "second_factor.totp_enabled"
+	ActionTOTPDisabled             = "second_factor.totp_disabled"
+	ActionRecoveryCodesRegenerated = "second_factor.recovery_codes_regenerated"
+	ActionWebAuthnRegistered       = "second_factor.webauthn_registered"
+	ActionWebAuthnRemoved          = "second_factor.webauthn_removed"
+	ActionSecondFactorVerified     = "second_factor.verified"
+	ActionSecondFactorFailed       = "second_factor.failed"
+
+	ActionAdminListUsers    = "admin.list_users"
+	ActionAdminViewUser     = "admin.view_user"
+	ActionAdminSuspend      = "admin.suspend_user"
+	ActionAdminReactivate   = "admin.reactivate_user"
+	ActionAdminResetVault   = "admin.reset_vault"
+	ActionAdminViewStats    = "admin.view_stats"
+	ActionAdminExportEvents = "admin.export_events"
+	ActionAdminVerifyAudit  = "admin.verify_audit"
+	ActionAdminAuditHead    = "admin.audit_head"
+)
+
+// Event is an audit record to be written.
+type Event struct {
+	// ActorUID is the identity-provider UID of whoever acted, empty when the
+	// caller could not be identified.
+	ActorUID string
+	// UserID is the account whose history the event belongs to. When nil it
+	// is the actor's own account, if they have one.
+	UserID *uuid.UUID
+	Action string
+	// TargetType and TargetID name the object acted on, such as an entry or
+	// a device.
+	TargetType string
+	TargetID   string
+	IP         string
+	UserAgent  string
+	Details    map[string]interface{}
+}
+
+// Querier is satisfied by *sql.DB and *sql.Tx, so an event can be written in
+// the transaction of the change it describes.
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Record writes e to the audit log. Given a *sql.Tx, the event commits or
+// rolls back with the change it describes. It joins the hash chain shortly
+// after, when Seal next runs; no lock is taken here, so audited writes do not
+// wait for one another.
+func Record(ctx context.Context, q Querier, e Event) error {
+	return insertEvent(ctx, q, e)
+}
+
+// Filter selects events for List. Zero fields do not filter.
+type Filter struct {
+	UserID  *uuid.UUID
+	Actions []string
+	Since   time.Time
+	Until   time.Time
+	// Limit caps the number of events; zero means no cap.
+	Limit  int
+	Offset int
+}
+
+// List calls fn for each event matching f, newest first, stopping at the
+// first error.
+func List(ctx context.Context, db *sql.DB, f Filter, fn func(models.AuditEvent) error) error {
+	var (
+		where []string
+		args  []interface{}
+	)
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	if f.UserID != nil {
+		where = append(where, "user_id = "+arg(*f.UserID))
+	}
+	if len(f.Actions) > 0 {
+		where = append(where, "action = ANY("+arg(pq.Array(f.Actions))+")")
+	}
+	if !f.Since.IsZero() {
+		where = append(where, "created_at >= "+arg(f.Since))
+	}
+	if !f.Until.IsZero() {
+		where = append(where, "created_at < "+arg(f.Until))
+	}
+
+	query := `
+		SELECT id, actor_uid, user_id, action, target_type, target_id, ip, user_agent, details, created_at, hash
+		FROM audit_events`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if f.Limit > 0 {
+		query += " LIMIT " + arg(f.Limit)
+	}
+	if f.Offset > 0 {
+		query += " OFFSET " + arg(f.Offset)
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			e                                          models.AuditEvent
+			actor, targetType, targetID, ip, userAgent sql.NullString
+			details, hash                              []byte
+		)
+		if err := rows.Scan(&e.ID, &actor, &e.UserID, &e.Action, &targetType, &targetID, &ip, &userAgent, &details, &e.CreatedAt, &hash); err != nil {
+			return err
+		}
+		e.ActorUID = actor.String
+		e.TargetType = targetType.String
+		e.TargetID = targetID.String
+		e.IP = ip.String
+		e.UserAgent = userAgent.String
+		if details != nil {
+			e.Details = json.RawMessage(details)
+		}
+		e.Hash = hex.EncodeToString(hash)
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
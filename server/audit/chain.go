@@ -0,0 +1,320 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"password-manager/models"
+)
+
+// chainLockKey is the transaction-level advisory lock that serializes Seal,
+// so each event links to the one sealed before it. It is only ever held by
+// Seal's own short transaction, never by a caller's.
+const chainLockKey int64 = 0x6b65797a79617564
+
+// sealBatchSize bounds the events chained in one Seal transaction.
+const sealBatchSize = 500
+
+// hashVersion is mixed into every hash so the encoding can change later
+// without old and new hashes being confused.
+const hashVersion = "keyzy-audit-v1"
+
+// link is an audit event as hashed. Each event's hash covers its contents,
+// its position seq in the chain, the hash of the event before it and the
+// hash of the same user's event before it, so editing, removing or
+// reordering any event breaks every hash after it, globally and in that
+// user's history.
+type link struct {
+	id           int64
+	seq          int64
+	actorUID     string
+	userID       *uuid.UUID
+	action       string
+	targetType   string
+	targetID     string
+	ip           string
+	userAgent    string
+	details      []byte
+	createdAt    time.Time
+	prevHash     []byte
+	userPrevHash []byte
+}
+
+func (l *link) sum() []byte {
+	h := sha256.New()
+	field := func(b []byte) {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(b)))
+		h.Write(n[:])
+		h.Write(b)
+	}
+	var id, seq [8]byte
+	binary.BigEndian.PutUint64(id[:], uint64(l.id))
+	binary.BigEndian.PutUint64(seq[:], uint64(l.seq))
+	var userID string
+	if l.userID != nil {
+		userID = l.userID.String()
+	}
+
+	field([]byte(hashVersion))
+	field(l.prevHash)
+	field(l.userPrevHash)
+	field(id[:])
+	field(seq[:])
+	field([]byte(l.actorUID))
+	field([]byte(userID))
+	field([]byte(l.action))
+	field([]byte(l.targetType))
+	field([]byte(l.targetID))
+	field([]byte(l.ip))
+	field([]byte(l.userAgent))
+	field(l.details)
+	field([]byte(l.createdAt.UTC().Format(time.RFC3339Nano)))
+	return h.Sum(nil)
+}
+
+// insertEvent writes e unsealed: without a place in the chain, which Seal
+// gives it once the transaction q may be part of has committed.
+func insertEvent(ctx context.Context, q Querier, e Event) error {
+	var details []byte
+	if len(e.Details) > 0 {
+		var err error
+		if details, err = json.Marshal(e.Details); err != nil {
+			return err
+		}
+	}
+	// The database keeps microseconds.
+	createdAt := time.Now().UTC().Truncate(time.Microsecond)
+
+	_, err := q.ExecContext(ctx, `
+		INSERT INTO audit_events (actor_uid, user_id, action, target_type, target_id, ip, user_agent, details, created_at)
+		VALUES ($1, COALESCE($2, (SELECT id FROM users WHERE firebase_uid = $1)), $3, $4, $5, $6, $7, $8, $9)
+	`, nullString(e.ActorUID), e.UserID, e.Action, nullString(e.TargetType), nullString(e.TargetID),
+		nullString(e.IP), nullString(e.UserAgent), nullString(string(details)), createdAt)
+	return err
+}
+
+// Seal chains committed events that have no place in the chain yet, oldest
+// first, and returns how many it sealed. It runs in a short transaction of
+// its own holding the chain lock, so business transactions never wait for
+// one another on the audit log. Sealing in commit order rather than ID order
+// means events of transactions that commit late still join the chain.
+//
+// An event whose hash is cleared keeps its seq and is reported by Verify;
+// one whose seq is cleared too is sealed again at the end, which breaks the
+// link from the event that followed it.
+func Seal(ctx context.Context, db *sql.DB) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, chainLockKey); err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, actor_uid, user_id, action, target_type, target_id, ip, user_agent, details, created_at
+		FROM audit_events WHERE seq IS NULL ORDER BY id LIMIT $1
+	`, sealBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var links []link
+	for rows.Next() {
+		var (
+			l                                                   link
+			actor, targetType, targetID, ip, userAgent, details sql.NullString
+		)
+		if err := rows.Scan(&l.id, &actor, &l.userID, &l.action, &targetType, &targetID, &ip, &userAgent, &details, &l.createdAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		l.actorUID = actor.String
+		l.targetType = targetType.String
+		l.targetID = targetID.String
+		l.ip = ip.String
+		l.userAgent = userAgent.String
+		if details.Valid {
+			l.details = []byte(details.String)
+		}
+		links = append(links, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(links) == 0 {
+		return 0, nil
+	}
+
+	var (
+		seq  int64
+		prev []byte
+	)
+	err = tx.QueryRowContext(ctx, `
+		SELECT seq, hash FROM audit_events WHERE seq IS NOT NULL ORDER BY seq DESC LIMIT 1
+	`).Scan(&seq, &prev)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	userPrev := map[uuid.UUID][]byte{}
+	for _, l := range links {
+		seq++
+		l.seq = seq
+		l.prevHash = prev
+		if l.userID != nil {
+			userPrevHash, ok := userPrev[*l.userID]
+			if !ok {
+				err := tx.QueryRowContext(ctx, `
+					SELECT hash FROM audit_events WHERE user_id = $1 AND seq IS NOT NULL ORDER BY seq DESC LIMIT 1
+				`, *l.userID).Scan(&userPrevHash)
+				if err != nil && err != sql.ErrNoRows {
+					return 0, err
+				}
+			}
+			l.userPrevHash = userPrevHash
+		}
+		hash := l.sum()
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE audit_events SET seq = $2, prev_hash = $3, user_prev_hash = $4, hash = $5 WHERE id = $1
+		`, l.id, l.seq, nullBytes(l.prevHash), nullBytes(l.userPrevHash), hash); err != nil {
+			return 0, err
+		}
+		prev = hash
+		if l.userID != nil {
+			userPrev[*l.userID] = hash
+		}
+	}
+	return len(links), tx.Commit()
+}
+
+// Verify walks the whole chain in order and reports the first event whose
+// hash does not match its contents or whose links do not match the events
+// before it. Events cut off the end of the chain can only be detected
+// against a head recorded earlier; see CheckHead. Events not sealed yet are
+// counted, not checked.
+func Verify(ctx context.Context, db *sql.DB) (models.AuditVerification, error) {
+	var result models.AuditVerification
+
+	if err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM audit_events WHERE seq IS NULL
+	`).Scan(&result.Pending); err != nil {
+		return result, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, seq, actor_uid, user_id, action, target_type, target_id, ip, user_agent, details,
+			created_at, prev_hash, user_prev_hash, hash
+		FROM audit_events WHERE seq IS NOT NULL ORDER BY seq
+	`)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	var prev []byte
+	userPrev := map[uuid.UUID][]byte{}
+	for rows.Next() {
+		var (
+			l                                                   link
+			actor, targetType, targetID, ip, userAgent, details sql.NullString
+			hash                                                []byte
+		)
+		if err := rows.Scan(&l.id, &l.seq, &actor, &l.userID, &l.action, &targetType, &targetID, &ip, &userAgent, &details,
+			&l.createdAt, &l.prevHash, &l.userPrevHash, &hash); err != nil {
+			return result, err
+		}
+		l.actorUID = actor.String
+		l.targetType = targetType.String
+		l.targetID = targetID.String
+		l.ip = ip.String
+		l.userAgent = userAgent.String
+		if details.Valid {
+			l.details = []byte(details.String)
+		}
+		result.Events++
+
+		var wantUserPrev []byte
+		if l.userID != nil {
+			wantUserPrev = userPrev[*l.userID]
+		}
+		var reason string
+		switch {
+		case l.seq != result.Events:
+			reason = "sequence number is out of order; events were removed or inserted"
+		case hash == nil:
+			reason = "event is not sealed"
+		case !bytes.Equal(l.prevHash, prev):
+			reason = "previous hash does not match the preceding event; events were removed, inserted or reordered"
+		case !bytes.Equal(l.userPrevHash, wantUserPrev):
+			reason = "previous user hash does not match the user's preceding event; the user's events were removed, inserted or reassigned"
+		case !bytes.Equal(l.sum(), hash):
+			reason = "hash does not match the event's contents; the event was altered"
+		}
+		if reason != "" {
+			result.Broken = &models.AuditChainBreak{ID: l.id, Reason: reason}
+			return result, nil
+		}
+
+		prev = hash
+		if l.userID != nil {
+			userPrev[*l.userID] = hash
+		}
+		result.Head = &models.AuditChainHead{ID: l.id, Hash: hex.EncodeToString(hash), CreatedAt: l.createdAt}
+	}
+	return result, rows.Err()
+}
+
+// Head returns the latest sealed event of the chain, or nil if it is empty.
+func Head(ctx context.Context, db *sql.DB) (*models.AuditChainHead, error) {
+	var (
+		head models.AuditChainHead
+		hash []byte
+	)
+	err := db.QueryRowContext(ctx, `
+		SELECT id, hash, created_at FROM audit_events WHERE seq IS NOT NULL ORDER BY seq DESC LIMIT 1
+	`).Scan(&head.ID, &hash, &head.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	head.Hash = hex.EncodeToString(hash)
+	return &head, nil
+}
+
+// CheckHead reports whether a head recorded earlier is still part of the
+// chain, with the same hash.
+func CheckHead(ctx context.Context, db *sql.DB, head models.AuditChainHead) error {
+	var hash []byte
+	err := db.QueryRowContext(ctx, `SELECT hash FROM audit_events WHERE id = $1`, head.ID).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("event %d is missing; the chain was truncated", head.ID)
+	}
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash) != head.Hash {
+		return fmt.Errorf("event %d has hash %x, recorded as %s", head.ID, hash, head.Hash)
+	}
+	return nil
+}
+
+func nullBytes(b []byte) interface{} {
+	if len(b) == 0 {
+		return nil
+	}
+	return b
+}
@@ -0,0 +1,53 @@
+// Package auth verifies bearer tokens issued by an identity provider and maps
+// them to an Identity. The middleware depends only on the TokenVerifier
+// interface, so Firebase is one provider among several (OIDC, local dev).
+package auth
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrInvalidToken is returned for tokens that fail signature, issuer,
+// audience or expiry checks. Verifiers wrap it with the specific reason.
+var ErrInvalidToken = errors.New("invalid token")
+
+// ErrUserDisabled is returned by a RevocationSource when the provider has
+// disabled the account; all of its tokens are treated as revoked.
+var ErrUserDisabled = errors.New("user is disabled")
+
+// Identity is the verified subject of a token.
+type Identity struct {
+	// UID is the provider's stable user identifier. It is stored in
+	// users.firebase_uid for every provider.
+	UID           string
+	Email         string
+	EmailVerified bool
+	// IssuedAt is when the token was minted; AuthTime is when the user last
+	// actively authenticated, if the provider reports it.
+	IssuedAt time.Time
+	AuthTime time.Time
+	// Claims holds the raw token claims for provider-specific checks.
+	Claims map[string]interface{}
+}
+
+// TokenVerifier checks a raw bearer token and returns its identity.
+type TokenVerifier interface {
+	Verify(ctx context.Context, token string) (*Identity, error)
+}
+
+// RevocationSource is implemented by providers that track token revocation
+// themselves. Tokens issued before TokensValidAfter are rejected in addition to
+// the server's own per-user revocation timestamp.
+type RevocationSource interface {
+	TokensValidAfter(ctx context.Context, uid string) (time.Time, error)
+	RevokeTokens(ctx context.Context, uid string) error
+}
+
+// IdentityDeleter is implemented by providers whose accounts the server can
+// delete. Account deletion removes the provider identity through it before
+// the local user row; deleting an identity that no longer exists succeeds.
+type IdentityDeleter interface {
+	DeleteIdentity(ctx context.Context, uid string) error
+}
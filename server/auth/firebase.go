@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	firebase "firebase.google.com/go/v4"
+	firebaseauth "firebase.google.com/go/v4/auth"
+	"google.golang.org/api/option"
+)
+
+// FirebaseVerifier verifies Firebase ID tokens.
+type FirebaseVerifier struct {
+	client *firebaseauth.Client
+}
+
+// NewFirebaseVerifier initializes Firebase auth from a service account file,
+// or from application default credentials when the path is empty. It returns
+// an error rather than silently disabling authentication.
+func NewFirebaseVerifier(ctx context.Context, credentialsFile string) (*FirebaseVerifier, error) {
+	var app *firebase.App
+	var err error
+
+	if credentialsFile != "" {
+		if _, statErr := os.Stat(credentialsFile); os.IsNotExist(statErr) {
+			return nil, fmt.Errorf("Firebase service account file not found at: %s", credentialsFile)
+		}
+		app, err = firebase.NewApp(ctx, nil, option.WithCredentialsFile(credentialsFile))
+	} else {
+		slog.Info("GOOGLE_APPLICATION_CREDENTIALS not set; trying default credentials")
+		app, err = firebase.NewApp(ctx, nil)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize Firebase app: %w", err)
+	}
+
+	client, err := app.Auth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Firebase Auth client: %w", err)
+	}
+
+	slog.Info("Firebase authentication initialized")
+	return &FirebaseVerifier{client: client}, nil
+}
+
+// Verify checks a Firebase ID token.
+func (v *FirebaseVerifier) Verify(ctx context.Context, idToken string) (*Identity, error) {
+	token, err := v.client.VerifyIDToken(ctx, idToken)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	id := &Identity{
+		UID:      token.UID,
+		IssuedAt: time.Unix(token.IssuedAt, 0),
+		AuthTime: time.Unix(token.AuthTime, 0),
+		Claims:   token.Claims,
+	}
+	id.Email, _ = token.Claims["email"].(string)
+	id.EmailVerified, _ = token.Claims["email_verified"].(bool)
+	return id, nil
+}
+
+// TokensValidAfter reports Firebase's revocation time for uid, which moves
+// forward when refresh tokens are revoked or the password is reset.
+func (v *FirebaseVerifier) TokensValidAfter(ctx context.Context, uid string) (time.Time, error) {
+	user, err := v.client.GetUser(ctx, uid)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to look up Firebase user: %w", err)
+	}
+	if user.Disabled {
+		return time.Time{}, ErrUserDisabled
+	}
+	return time.UnixMilli(user.TokensValidAfterMillis), nil
+}
+
+// RevokeTokens revokes every Firebase refresh token issued to uid.
+func (v *FirebaseVerifier) RevokeTokens(ctx context.Context, uid string) error {
+	return v.client.RevokeRefreshTokens(ctx, uid)
+}
+
+// DeleteIdentity deletes the Firebase user uid.
+func (v *FirebaseVerifier) DeleteIdentity(ctx context.Context, uid string) error {
+	if err := v.client.DeleteUser(ctx, uid); err != nil && !firebaseauth.IsUserNotFound(err) {
+		return fmt.Errorf("failed to delete Firebase user: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"strings"
+	"time"
+)
+
+const (
+	// RecoveryCodeCount is how many single-use recovery codes a user is given.
+	RecoveryCodeCount = 10
+	// StepUpTTL is how long a second-factor check unlocks sensitive routes.
+	StepUpTTL = 5 * time.Minute
+)
+
+var recoveryEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// NewRecoveryCodes generates RecoveryCodeCount recovery codes and their
+// hashes. Each code carries 80 random bits and is shown as four groups of
+// four characters, e.g. "abcd-efgh-ijkl-mnop".
+func NewRecoveryCodes() (codes []string, hashes [][]byte, err error) {
+	for range RecoveryCodeCount {
+		raw := make([]byte, 10)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		s := recoveryEncoding.EncodeToString(raw)
+		code := s[0:4] + "-" + s[4:8] + "-" + s[8:12] + "-" + s[12:16]
+		codes = append(codes, code)
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode returns the stored hash of a recovery code. Codes are
+// normalized first so users can type them without dashes or in upper case.
+func HashRecoveryCode(code string) []byte {
+	normalized := strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return sum[:]
+}
+
+// NewStepUpToken generates the token returned after a successful second-factor
+// check. Clients send it in the X-Step-Up-Token header to call sensitive
+// routes. Like access tokens, only the hash is stored.
+func NewStepUpToken() (token string, hash []byte, err error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	token = base64.RawURLEncoding.EncodeToString(secret)
+	return token, HashAccessToken(token), nil
+}
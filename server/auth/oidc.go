@@ -0,0 +1,243 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MicahParks/keyfunc"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// OIDCConfig describes a standards-based OpenID Connect provider such as
+// Keycloak, Authentik or Auth0.
+type OIDCConfig struct {
+	Issuer   string
+	Audience string
+	// JWKSURL or JWKSFile supplies the signing keys. When both are empty the
+	// URL is discovered from the issuer's openid-configuration document.
+	JWKSURL  string
+	JWKSFile string
+	// UIDClaim and EmailClaim name the claims mapped onto Identity; they
+	// default to "sub" and "email".
+	UIDClaim   string
+	EmailClaim string
+}
+
+// signingMethods are the asymmetric algorithms accepted from a JWKS. HMAC is
+// deliberately excluded: a public key must never double as a shared secret.
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// OIDCVerifier verifies JWTs against a provider's published keys. Remote key
+// sets are cached, refreshed hourly and re-fetched when a token names an
+// unknown key ID, so provider key rotation needs no restart.
+type OIDCVerifier struct {
+	cfg     OIDCConfig
+	parser  *jwt.Parser
+	keyfunc jwt.Keyfunc
+	jwks    *keyfunc.JWKS // set for remote key sets, to stop refreshing
+}
+
+// NewOIDCVerifier loads the provider's keys and returns a verifier.
+func NewOIDCVerifier(ctx context.Context, cfg OIDCConfig) (*OIDCVerifier, error) {
+	if cfg.Issuer == "" {
+		return nil, errors.New("OIDC issuer is required")
+	}
+	if cfg.Audience == "" {
+		return nil, errors.New("OIDC audience is required")
+	}
+	if cfg.UIDClaim == "" {
+		cfg.UIDClaim = "sub"
+	}
+	if cfg.EmailClaim == "" {
+		cfg.EmailClaim = "email"
+	}
+
+	v := &OIDCVerifier{
+		cfg:    cfg,
+		parser: jwt.NewParser(jwt.WithValidMethods(signingMethods)),
+	}
+
+	switch {
+	case cfg.JWKSFile != "":
+		keys, err := newFileKeySet(cfg.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		v.keyfunc = keys.Keyfunc
+	default:
+		url := cfg.JWKSURL
+		if url == "" {
+			discovered, err := discoverJWKSURL(ctx, cfg.Issuer)
+			if err != nil {
+				return nil, err
+			}
+			url = discovered
+		}
+		jwks, err := keyfunc.Get(url, keyfunc.Options{
+			Ctx:               ctx,
+			RefreshInterval:   time.Hour,
+			RefreshRateLimit:  5 * time.Minute,
+			RefreshTimeout:    10 * time.Second,
+			RefreshUnknownKID: true,
+			RefreshErrorHandler: func(err error) {
+				slog.Error("failed to refresh OIDC signing keys", "err", err)
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load OIDC signing keys from %s: %w", url, err)
+		}
+		v.jwks = jwks
+		v.keyfunc = jwks.Keyfunc
+	}
+
+	slog.Info("OIDC authentication initialized", "issuer", cfg.Issuer)
+	return v, nil
+}
+
+// Close stops background key refreshes.
+func (v *OIDCVerifier) Close() {
+	if v.jwks != nil {
+		v.jwks.EndBackground()
+	}
+}
+
+// Verify checks the token's signature, expiry, issuer and audience, then maps
+// the configured claims onto an Identity.
+func (v *OIDCVerifier) Verify(ctx context.Context, raw string) (*Identity, error) {
+	claims := jwt.MapClaims{}
+	if _, err := v.parser.ParseWithClaims(raw, claims, v.keyfunc); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if !claims.VerifyIssuer(v.cfg.Issuer, true) {
+		return nil, fmt.Errorf("%w: unexpected issuer", ErrInvalidToken)
+	}
+	if !claims.VerifyAudience(v.cfg.Audience, true) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, fmt.Errorf("%w: missing exp claim", ErrInvalidToken)
+	}
+
+	uid, _ := claims[v.cfg.UIDClaim].(string)
+	if uid == "" {
+		return nil, fmt.Errorf("%w: missing %s claim", ErrInvalidToken, v.cfg.UIDClaim)
+	}
+
+	id := &Identity{
+		UID:      uid,
+		IssuedAt: numericTime(claims["iat"]),
+		AuthTime: numericTime(claims["auth_time"]),
+		Claims:   claims,
+	}
+	id.Email, _ = claims[v.cfg.EmailClaim].(string)
+	id.EmailVerified, _ = claims["email_verified"].(bool)
+	return id, nil
+}
+
+// numericTime converts a JWT NumericDate claim, decoded as float64.
+func numericTime(v interface{}) time.Time {
+	if f, ok := v.(float64); ok {
+		return time.Unix(int64(f), 0)
+	}
+	return time.Time{}
+}
+
+// discoverJWKSURL reads jwks_uri from the issuer's discovery document.
+func discoverJWKSURL(ctx context.Context, issuer string) (string, error) {
+	url := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("OIDC discovery failed: %s returned %s", url, resp.Status)
+	}
+
+	var doc struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return "", fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return "", fmt.Errorf("OIDC discovery document is for issuer %q, not %q", doc.Issuer, issuer)
+	}
+	if doc.JWKSURI == "" {
+		return "", errors.New("OIDC discovery document has no jwks_uri")
+	}
+	return doc.JWKSURI, nil
+}
+
+// fileKeySet serves keys from a local JWKS file and reloads it when the file
+// changes, so keys can be rotated by replacing the file.
+type fileKeySet struct {
+	path string
+
+	mu      sync.Mutex
+	jwks    *keyfunc.JWKS
+	modTime time.Time
+	checked time.Time
+}
+
+// fileRecheckInterval bounds how often the file's mtime is checked.
+const fileRecheckInterval = 30 * time.Second
+
+func newFileKeySet(path string) (*fileKeySet, error) {
+	ks := &fileKeySet{path: path}
+	if err := ks.load(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+func (ks *fileKeySet) load() error {
+	info, err := os.Stat(ks.path)
+	if err != nil {
+		return fmt.Errorf("failed to read JWKS file: %w", err)
+	}
+	raw, err := os.ReadFile(ks.path)
+	if err != nil {
+		return fmt.Errorf("failed to read JWKS file: %w", err)
+	}
+	jwks, err := keyfunc.NewJSON(raw)
+	if err != nil {
+		return fmt.Errorf("failed to parse JWKS file %s: %w", ks.path, err)
+	}
+	ks.jwks, ks.modTime, ks.checked = jwks, info.ModTime(), time.Now()
+	return nil
+}
+
+// Keyfunc resolves the token's key, reloading the file first if it has been
+// modified since it was last read.
+func (ks *fileKeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	ks.mu.Lock()
+	if time.Since(ks.checked) > fileRecheckInterval {
+		ks.checked = time.Now()
+		if info, err := os.Stat(ks.path); err == nil && !info.ModTime().Equal(ks.modTime) {
+			if err := ks.load(); err != nil {
+				slog.Warn("keeping previous JWKS", "err", err)
+			}
+		}
+	}
+	jwks := ks.jwks
+	ks.mu.Unlock()
+
+	return jwks.Keyfunc(token)
+}
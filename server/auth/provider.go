@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"password-manager/config"
+)
+
+// NewVerifier builds the TokenVerifier selected by cfg.AuthProvider. On error
+// the returned interface is nil, not a typed nil pointer.
+func NewVerifier(ctx context.Context, cfg *config.Config) (TokenVerifier, error) {
+	var (
+		v   TokenVerifier
+		err error
+	)
+	switch cfg.AuthProvider {
+	case "", "firebase":
+		v, err = NewFirebaseVerifier(ctx, cfg.GoogleApplicationCredentials)
+	case "oidc":
+		v, err = NewOIDCVerifier(ctx, OIDCConfig{
+			Issuer:     cfg.OIDCIssuer,
+			Audience:   cfg.OIDCAudience,
+			JWKSURL:    cfg.OIDCJWKSURL,
+			JWKSFile:   cfg.OIDCJWKSFile,
+			UIDClaim:   cfg.OIDCUIDClaim,
+			EmailClaim: cfg.OIDCEmailClaim,
+		})
+	case "local":
+		var issuer *LocalIssuer
+		if issuer, err = NewLocalIssuer(cfg); err == nil {
+			slog.Warn("AUTH_PROVIDER=local accepts locally signed tokens — DO NOT use in production", "key_file", cfg.LocalAuthKeyFile)
+			v = issuer.Verifier()
+		}
+	default:
+		err = fmt.Errorf("unknown AUTH_PROVIDER %q", cfg.AuthProvider)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// NewLocalIssuer returns the development token issuer configured by cfg.
+func NewLocalIssuer(cfg *config.Config) (*LocalIssuer, error) {
+	return LoadLocalIssuer(cfg.LocalAuthKeyFile, cfg.LocalAuthIssuer, cfg.LocalAuthAudience)
+}
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// Personal access token scopes. A token may only call routes registered with
+// one of its scopes; routes without a scope are reserved for interactive
+// sessions.
+const (
+	ScopePasswordsRead  = "passwords:read"
+	ScopePasswordsWrite = "passwords:write"
+	ScopeVaultRead      = "vault:read"
+)
+
+// Scopes lists every scope a personal access token may be granted.
+var Scopes = []string{ScopePasswordsRead, ScopePasswordsWrite, ScopeVaultRead}
+
+// AccessTokenPrefix marks personal access tokens so the middleware can tell
+// them apart from identity-provider JWTs without trying to parse them.
+const AccessTokenPrefix = "kzy_pat_"
+
+// NewAccessToken generates a personal access token. Only its hash is stored;
+// the plaintext is shown to the user once.
+func NewAccessToken() (token string, hash []byte, err error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	token = AccessTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	return token, HashAccessToken(token), nil
+}
+
+// HashAccessToken returns the lookup hash of a token. The tokens carry 256
+// bits of randomness, so a fast hash is sufficient.
+func HashAccessToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// IsAccessToken reports whether a bearer token is a personal access token.
+func IsAccessToken(token string) bool {
+	return strings.HasPrefix(token, AccessTokenPrefix)
+}
+
+// AccessTokenHint is the non-secret leading part of a token shown in lists
+// so users can tell their tokens apart.
+func AccessTokenHint(token string) string {
+	return token[:len(AccessTokenPrefix)+6]
+}
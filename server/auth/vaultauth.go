@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters for new vault auth hashes (OWASP's 64 MiB profile).
+// Stored hashes carry their own parameters, so these can be raised later
+// without invalidating existing ones.
+const (
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+	argonKeyLen  = 32
+	argonSaltLen = 16
+)
+
+// maxArgonWorkers bounds how many Argon2id hashes run at once across the
+// process, and so the memory they hold to maxArgonWorkers × argonMemory.
+// Callers beyond it wait their turn.
+const maxArgonWorkers = 4
+
+var argonSlots = make(chan struct{}, maxArgonWorkers)
+
+// argonKey runs Argon2id once a slot is free, or gives up when ctx is done.
+func argonKey(ctx context.Context, password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) ([]byte, error) {
+	select {
+	case argonSlots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-argonSlots }()
+	return argon2.IDKey(password, salt, time, memory, threads, keyLen), nil
+}
+
+// Bounds on the client-derived auth hash, after base64 decoding.
+const (
+	minVaultAuthLen = 32
+	maxVaultAuthLen = 64
+)
+
+// ErrMalformedVaultAuth is returned for auth hashes that are not base64 or
+// have the wrong length.
+var ErrMalformedVaultAuth = errors.New("malformed vault auth hash")
+
+// DecodeVaultAuth decodes the base64 auth hash a client derives from its
+// master key. The client derives it separately from the key that unwraps the
+// vault key, so the server never learns anything that decrypts the vault.
+func DecodeVaultAuth(encoded string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) < minVaultAuthLen || len(raw) > maxVaultAuthLen {
+		return nil, ErrMalformedVaultAuth
+	}
+	return raw, nil
+}
+
+// HashVaultAuth returns the Argon2id hash of a client auth hash in the PHC
+// string format. The slow hash keeps a leaked database from being a fast
+// oracle for guessing master passwords.
+func HashVaultAuth(ctx context.Context, authHash []byte) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := argonKey(ctx, authHash, salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argonMemory, argonTime, argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyVaultAuth reports whether authHash matches a hash produced by
+// HashVaultAuth.
+func VerifyVaultAuth(ctx context.Context, encoded string, authHash []byte) (bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, fmt.Errorf("unsupported vault auth hash format")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	var (
+		memory  uint32
+		time    uint32
+		threads uint8
+	)
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, fmt.Errorf("invalid argon2 parameters: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2 hash: %w", err)
+	}
+
+	got, err := argonKey(ctx, authHash, salt, time, memory, threads, uint32(len(want)))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
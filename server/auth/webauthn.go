@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+
+	"password-manager/config"
+)
+
+// WebAuthnTimeout bounds how long a registration or assertion ceremony may
+// take between its begin and finish calls.
+const WebAuthnTimeout = 5 * time.Minute
+
+// NewWebAuthn returns the WebAuthn relying party configured by cfg, or nil if
+// WebAuthn is not configured.
+func NewWebAuthn(cfg *config.Config) (*webauthn.WebAuthn, error) {
+	if cfg.WebAuthnRPID == "" {
+		return nil, nil
+	}
+	if len(cfg.WebAuthnRPOrigins) == 0 {
+		return nil, fmt.Errorf("WEBAUTHN_RP_ORIGINS is required when WEBAUTHN_RP_ID is set")
+	}
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: WebAuthnTimeout}
+	return webauthn.New(&webauthn.Config{
+		RPID:          cfg.WebAuthnRPID,
+		RPDisplayName: cfg.WebAuthnRPName,
+		RPOrigins:     cfg.WebAuthnRPOrigins,
+		// Used as a second factor after the identity provider sign-in, so
+		// user presence is enough; keys without a PIN still work.
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			UserVerification: protocol.VerificationPreferred,
+		},
+		AttestationPreference: protocol.PreferNoAttestation,
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        timeout,
+			Registration: timeout,
+		},
+	})
+}
@@ -0,0 +1,269 @@
+// Package breach serves Have I Been Pwned style k-anonymity range lookups from
+// a locally imported copy of the SHA-1 password hash dataset. Nothing is sent
+// to third parties: clients send the first five hex characters of a hash and
+// receive every known suffix sharing that prefix.
+//
+// The dataset is the sorted "HASH:COUNT" text file published by HIBP. Import
+// builds a companion index holding the byte offset of the first line for each
+// of the 16^5 possible prefixes, so a lookup is two small ReadAt calls.
+package breach
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// PrefixLength is the number of hex characters a client sends.
+	PrefixLength = 5
+	hashLength   = 40
+
+	prefixCount = 1 << (4 * PrefixLength)
+	indexMagic  = "KZYBRIX1"
+	// Header: magic, dataset size. Followed by prefixCount+1 offsets.
+	headerSize = len(indexMagic) + 8
+
+	// maxRangeBytes guards against a corrupt index pointing at a huge span.
+	// Real ranges are a few tens of kilobytes.
+	maxRangeBytes = 4 << 20
+)
+
+// ErrInvalidPrefix is returned for prefixes that are not five hex characters.
+var ErrInvalidPrefix = errors.New("prefix must be 5 hexadecimal characters")
+
+// Store answers range queries from an imported dataset and its index.
+type Store struct {
+	dataset *os.File
+	index   *os.File
+}
+
+// DefaultIndexPath is the index location used when none is configured.
+func DefaultIndexPath(datasetPath string) string {
+	return datasetPath + ".idx"
+}
+
+// Open opens a dataset and the index built for it by Import. It refuses an
+// index built for a different version of the dataset.
+func Open(datasetPath, indexPath string) (*Store, error) {
+	dataset, err := os.Open(datasetPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open breach dataset: %w", err)
+	}
+	index, err := os.Open(indexPath)
+	if err != nil {
+		dataset.Close()
+		return nil, fmt.Errorf("failed to open breach index: %w", err)
+	}
+
+	s := &Store{dataset: dataset, index: index}
+	if err := s.checkIndex(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) checkIndex() error {
+	header := make([]byte, headerSize)
+	if _, err := s.index.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("failed to read breach index header: %w", err)
+	}
+	if string(header[:len(indexMagic)]) != indexMagic {
+		return errors.New("breach index has an unknown format; re-run `keyzy breach import`")
+	}
+
+	info, err := s.dataset.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat breach dataset: %w", err)
+	}
+	if size := binary.BigEndian.Uint64(header[len(indexMagic):]); size != uint64(info.Size()) {
+		return errors.New("breach index does not match the dataset; re-run `keyzy breach import`")
+	}
+	return nil
+}
+
+// Close releases the underlying files.
+func (s *Store) Close() error {
+	return errors.Join(s.dataset.Close(), s.index.Close())
+}
+
+// Range returns every hash suffix that shares the given prefix, in the HIBP
+// range response format: "SUFFIX:COUNT" lines separated by CRLF.
+func (s *Store) Range(prefix string) ([]byte, error) {
+	p, ok := parsePrefix(prefix)
+	if !ok {
+		return nil, ErrInvalidPrefix
+	}
+
+	var bounds [16]byte
+	if _, err := s.index.ReadAt(bounds[:], int64(headerSize+p*8)); err != nil {
+		return nil, fmt.Errorf("failed to read breach index: %w", err)
+	}
+	start := binary.BigEndian.Uint64(bounds[:8])
+	end := binary.BigEndian.Uint64(bounds[8:])
+	if end < start || end-start > maxRangeBytes {
+		return nil, errors.New("breach index is corrupt")
+	}
+
+	chunk := make([]byte, end-start)
+	if _, err := s.dataset.ReadAt(chunk, int64(start)); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read breach dataset: %w", err)
+	}
+
+	var out bytes.Buffer
+	for _, line := range bytes.Split(chunk, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) < hashLength {
+			continue
+		}
+		out.Write(bytes.ToUpper(line[PrefixLength:hashLength]))
+		out.Write(line[hashLength:])
+		out.WriteString("\r\n")
+	}
+	return out.Bytes(), nil
+}
+
+// Import scans a sorted "HASH:COUNT" dataset and writes its prefix index to
+// indexPath. The index is written to a temporary file and renamed into place,
+// so a running server never sees a partial index.
+func Import(datasetPath, indexPath string) (lines int, err error) {
+	dataset, err := os.Open(datasetPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open breach dataset: %w", err)
+	}
+	defer dataset.Close()
+
+	offsets := make([]uint64, prefixCount+1)
+	next := 0 // first prefix whose offset has not been set yet
+	var (
+		pos  uint64
+		last []byte
+	)
+
+	r := bufio.NewReaderSize(dataset, 1<<20)
+	for {
+		line, readErr := r.ReadSlice('\n')
+		if errors.Is(readErr, bufio.ErrBufferFull) {
+			return lines, fmt.Errorf("line %d is too long", lines+1)
+		}
+		if len(line) > 0 {
+			start := pos
+			pos += uint64(len(line))
+
+			trimmed := bytes.TrimSpace(line)
+			if len(trimmed) > 0 {
+				hash, err := parseLine(trimmed)
+				if err != nil {
+					return lines, fmt.Errorf("line %d: %w", lines+1, err)
+				}
+				if last != nil && bytes.Compare(hash, last) <= 0 {
+					return lines, fmt.Errorf("line %d: dataset is not sorted by hash", lines+1)
+				}
+				last = append(last[:0], hash...)
+
+				p, _ := parsePrefix(string(hash[:PrefixLength]))
+				for ; next <= p; next++ {
+					offsets[next] = start
+				}
+				lines++
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return lines, fmt.Errorf("failed to read breach dataset: %w", readErr)
+		}
+	}
+	for ; next <= prefixCount; next++ {
+		offsets[next] = pos
+	}
+
+	if err := writeIndex(indexPath, pos, offsets); err != nil {
+		return lines, err
+	}
+	return lines, nil
+}
+
+func writeIndex(indexPath string, datasetSize uint64, offsets []uint64) error {
+	tmp, err := os.CreateTemp(filepath.Dir(indexPath), filepath.Base(indexPath)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create breach index: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	w.WriteString(indexMagic)
+	binary.Write(w, binary.BigEndian, datasetSize)
+	if err := binary.Write(w, binary.BigEndian, offsets); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write breach index: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write breach index: %w", err)
+	}
+	// CreateTemp uses 0600; the index is no more sensitive than the dataset.
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write breach index: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write breach index: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), indexPath); err != nil {
+		return fmt.Errorf("failed to install breach index: %w", err)
+	}
+	return nil
+}
+
+// parseLine validates a "HASH:COUNT" line and returns the upper-cased hash.
+func parseLine(line []byte) ([]byte, error) {
+	hash, count, ok := bytes.Cut(line, []byte(":"))
+	if !ok || len(hash) != hashLength || len(count) == 0 {
+		return nil, errors.New(`expected "HASH:COUNT"`)
+	}
+	hash = bytes.ToUpper(hash)
+	for _, c := range hash {
+		if !isHex(c) {
+			return nil, errors.New("hash is not a SHA-1 hex digest")
+		}
+	}
+	for _, c := range count {
+		if c < '0' || c > '9' {
+			return nil, errors.New("count is not a number")
+		}
+	}
+	return hash, nil
+}
+
+// parsePrefix converts a five-character hex prefix to its index slot.
+func parsePrefix(prefix string) (int, bool) {
+	if len(prefix) != PrefixLength {
+		return 0, false
+	}
+	p := 0
+	for _, c := range []byte(strings.ToUpper(prefix)) {
+		if !isHex(c) {
+			return 0, false
+		}
+		p <<= 4
+		if c <= '9' {
+			p |= int(c - '0')
+		} else {
+			p |= int(c-'A') + 10
+		}
+	}
+	return p, true
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'A' && c <= 'F')
+}
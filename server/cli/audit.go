@@ -0,0 +1,147 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"password-manager/audit"
+	"password-manager/config"
+	"password-manager/database"
+	"password-manager/models"
+)
+
+// auditVerify walks the audit chain and fails at the first broken link. With
+// --notary it also checks every head recorded in that file is still in the
+// chain, which catches events cut off the end.
+func auditVerify(args []string) error {
+	cfg, err := config.Load(nil)
+	if err != nil {
+		return err
+	}
+
+	fs := newFlagSet("audit verify")
+	notary := fs.String("notary", "", "file of heads written by `keyzy audit head`")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := requireNoArgs(fs); err != nil {
+		return err
+	}
+
+	db, err := database.Connect(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	result, err := audit.Verify(ctx, db)
+	if err != nil {
+		return err
+	}
+	if result.Broken != nil {
+		return fmt.Errorf("chain broken at event %d after %d events: %s", result.Broken.ID, result.Events-1, result.Broken.Reason)
+	}
+
+	if *notary != "" {
+		heads, err := readNotary(*notary)
+		if err != nil {
+			return err
+		}
+		for _, head := range heads {
+			if err := audit.CheckHead(ctx, db, head); err != nil {
+				return fmt.Errorf("notarized head from %s: %w", head.CreatedAt.Format(time.RFC3339), err)
+			}
+		}
+		fmt.Printf("Checked %d notarized heads\n", len(heads))
+	}
+
+	if result.Head == nil {
+		fmt.Println("Audit chain is empty")
+		return nil
+	}
+	fmt.Printf("Verified %d events; head is event %d (%s)\n", result.Events, result.Head.ID, result.Head.Hash)
+	if result.Pending > 0 {
+		fmt.Printf("%d newer events are not sealed into the chain yet\n", result.Pending)
+	}
+	return nil
+}
+
+// auditHead prints the current chain head as JSON and, with --notary,
+// appends it to that file for safekeeping outside the database.
+func auditHead(args []string) error {
+	cfg, err := config.Load(nil)
+	if err != nil {
+		return err
+	}
+
+	fs := newFlagSet("audit head")
+	notary := fs.String("notary", "", "file to append the head to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := requireNoArgs(fs); err != nil {
+		return err
+	}
+
+	db, err := database.Connect(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	head, err := audit.Head(context.Background(), db)
+	if err != nil {
+		return err
+	}
+	if head == nil {
+		return fmt.Errorf("audit chain is empty")
+	}
+	line, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+
+	if *notary != "" {
+		f, err := os.OpenFile(*notary, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	fmt.Println(string(line))
+	return nil
+}
+
+// readNotary reads the heads in a notary file, one JSON object per line.
+func readNotary(path string) ([]models.AuditChainHead, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var heads []models.AuditChainHead
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var head models.AuditChainHead
+		if err := json.Unmarshal(scanner.Bytes(), &head); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		heads = append(heads, head)
+	}
+	return heads, scanner.Err()
+}
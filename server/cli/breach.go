@@ -0,0 +1,43 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"password-manager/breach"
+	"password-manager/config"
+)
+
+// breachImport builds the prefix index for a sorted HIBP SHA-1 dataset. Paths
+// default to BREACH_DATASET_PATH and BREACH_INDEX_PATH.
+func breachImport(args []string) error {
+	cfg, err := config.Load(nil)
+	if err != nil {
+		return err
+	}
+
+	fs := newFlagSet("breach import")
+	dataset := fs.String("dataset", cfg.BreachDatasetPath, "path to the sorted HASH:COUNT dataset")
+	index := fs.String("index", cfg.BreachIndexPath, "where to write the index (default: <dataset>.idx)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := requireNoArgs(fs); err != nil {
+		return err
+	}
+	if *dataset == "" {
+		return errors.New("no dataset given; pass --dataset or set BREACH_DATASET_PATH")
+	}
+	if *index == "" {
+		*index = breach.DefaultIndexPath(*dataset)
+	}
+
+	start := time.Now()
+	lines, err := breach.Import(*dataset, *index)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Indexed %d hashes from %s into %s in %s\n", lines, *dataset, *index, time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,127 @@
+// Package cli implements the operator subcommands of the server binary, e.g.
+// `keyzy breach import`. Running the binary without arguments, or with only
+// flags, starts the HTTP server instead.
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// command is a named subcommand group such as "breach".
+type command struct {
+	summary     string
+	subcommands map[string]subcommand
+}
+
+type subcommand struct {
+	summary string
+	run     func(args []string) error
+}
+
+var commands = map[string]command{
+	"audit": {
+		summary: "check the tamper-evident audit log",
+		subcommands: map[string]subcommand{
+			"verify": {summary: "walk the hash chain and report the first broken link", run: auditVerify},
+			"head":   {summary: "print the chain head, optionally appending it to a notary file", run: auditHead},
+		},
+	},
+	"breach": {
+		summary: "manage the local breached-password dataset",
+		subcommands: map[string]subcommand{
+			"import": {summary: "build the range index for a HIBP SHA-1 dataset", run: breachImport},
+		},
+	},
+	"config": {
+		summary: "inspect the server configuration",
+		subcommands: map[string]subcommand{
+			"check": {summary: "validate the configuration and print it with secrets redacted", run: configCheck},
+		},
+	},
+	"dev": {
+		summary: "development helpers (AUTH_PROVIDER=local)",
+		subcommands: map[string]subcommand{
+			"token": {summary: "mint a locally signed token for any user", run: devToken},
+		},
+	},
+}
+
+// Run executes the subcommand named by args and returns a process exit code.
+func Run(args []string) int {
+	if len(args) == 0 || args[0] == "help" {
+		usage(os.Stdout)
+		return 0
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		usage(os.Stderr)
+		return 2
+	}
+	if len(args) < 2 {
+		subUsage(os.Stderr, args[0], cmd)
+		return 2
+	}
+	sub, ok := cmd.subcommands[args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0]+" "+args[1])
+		subUsage(os.Stderr, args[0], cmd)
+		return 2
+	}
+
+	if err := sub.run(args[2:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "keyzy %s %s: %v\n", args[0], args[1], err)
+		return 1
+	}
+	return 0
+}
+
+// newFlagSet returns a flag set whose parse errors are reported, not fatal.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("keyzy "+name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	return fs
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: keyzy [command] [subcommand] [flags]")
+	fmt.Fprintln(w, "\nWith no command, the HTTP server is started; see `keyzy --help` for its flags.")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, name := range sortedKeys(commands) {
+		fmt.Fprintf(w, "  %-10s %s\n", name, commands[name].summary)
+	}
+}
+
+func subUsage(w io.Writer, name string, cmd command) {
+	fmt.Fprintf(w, "Usage: keyzy %s <subcommand> [flags]\n\nSubcommands:\n", name)
+	for _, sub := range sortedKeys(cmd.subcommands) {
+		fmt.Fprintf(w, "  %-10s %s\n", sub, cmd.subcommands[sub].summary)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// requireNoArgs rejects stray positional arguments left after flag parsing.
+func requireNoArgs(fs *flag.FlagSet) error {
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"password-manager/config"
+	"password-manager/middleware"
+	"password-manager/ratelimit"
+)
+
+// configCheck loads the configuration as the server would, with the same
+// flags, prints the effective settings with secrets redacted, and fails if
+// the server would refuse to start with them.
+func configCheck(args []string) error {
+	cfg, err := config.Load(args)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SETTING\tVALUE\tSOURCE")
+	for _, s := range cfg.Effective() {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", s.Key, s.Value, s.Source)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, policiesErr := ratelimit.ParsePolicies(cfg.RateLimitPolicies)
+	if err := errors.Join(cfg.Validate(), policiesErr, middleware.Configure(cfg)); err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	fmt.Println("\nConfiguration is valid")
+	return nil
+}
@@ -1,50 +1,213 @@
 package config
 
 import (
-	"log"
-	"os"
+	"errors"
+	"log/slog"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	DatabaseURL                  string
+	DatabaseURL string
+	// Database connection pool. A DBConnMaxLifetime of zero keeps
+	// connections open indefinitely.
+	DBMaxOpenConns               int
+	DBMaxIdleConns               int
+	DBConnMaxLifetime            time.Duration
 	FirebaseProject              string
 	GoogleApplicationCredentials string
 	Port                         string
-	AllowedOrigins               []string
-	AllowInsecureDevAuth         bool
+	// HTTP server timeouts, which guard against slow clients (e.g.
+	// Slowloris) and leaked connections.
+	ReadHeaderTimeout    time.Duration
+	ReadTimeout          time.Duration
+	WriteTimeout         time.Duration
+	IdleTimeout          time.Duration
+	AllowedOrigins       []string
+	AllowInsecureDevAuth bool
+	// AuthProvider selects the token verifier: "firebase" (default), "oidc",
+	// or "local" (development only).
+	AuthProvider      string
+	OIDCIssuer        string
+	OIDCAudience      string
+	OIDCJWKSURL       string
+	OIDCJWKSFile      string
+	OIDCUIDClaim      string
+	OIDCEmailClaim    string
+	LocalAuthKeyFile  string
+	LocalAuthIssuer   string
+	LocalAuthAudience string
+	BreachDatasetPath string
+	BreachIndexPath   string
+	// Per-user storage limits; zero means unlimited.
+	MaxEntriesPerUser int
+	MaxBytesPerUser   int64
+	// WebAuthn relying party. Security keys and passkeys are unavailable
+	// until WebAuthnRPID is set.
+	WebAuthnRPID      string
+	WebAuthnRPName    string
+	WebAuthnRPOrigins []string
+	// RequireSecondFactor makes step-up routes refuse users who have not
+	// enrolled a second factor, instead of letting them through.
+	RequireSecondFactor bool
+	// RequireVerifiedEmail refuses tokens whose email_verified claim is not
+	// true.
+	RequireVerifiedEmail bool
+	// AccountDeletionGracePeriod is how long a deleted account can still be
+	// restored before it is purged.
+	AccountDeletionGracePeriod time.Duration
+	// AdminClaim names a token claim that grants the admin role when it is
+	// true, "admin", or a list containing "admin". Empty means admins are
+	// only those with users.role = 'admin'.
+	AdminClaim string
+	// Notifier selects how security notifications are delivered: "smtp",
+	// "file" (an mbox file, for development) or "" to not send them.
+	Notifier     string
+	NotifierFile string
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+	// LogFormat is "json" (default) or "text"; LogLevel is debug, info, warn
+	// or error.
+	LogFormat string
+	LogLevel  string
+	// MetricsAddr is the listen address of a separate listener for
+	// /metrics, e.g. "127.0.0.1:9090". When empty, metrics are not served.
+	MetricsAddr string
+	// TracingExporter selects where OpenTelemetry spans go: "otlp" (the
+	// endpoint comes from the standard OTEL_EXPORTER_OTLP_* variables),
+	// "stdout", "file" (TracingFile) or empty for no tracing.
+	TracingExporter    string
+	TracingFile        string
+	TracingSampleRatio float64
+	// On SIGINT or SIGTERM the readiness probe fails for ShutdownDelay, so load
+	// balancers stop routing here, then in-flight requests get up to
+	// ShutdownTimeout to finish.
+	ShutdownDelay   time.Duration
+	ShutdownTimeout time.Duration
+	// RateLimitStore is where rate limits are counted: "memory" (per
+	// instance), "postgres" or "redis" (shared by all instances).
+	RateLimitStore    string
+	RateLimitRedisURL string
+	// RateLimitPolicies overrides the built-in rate limit policies; see
+	// ratelimit.ParsePolicies for the format.
+	RateLimitPolicies string
+	// TrustedProxies are the CIDRs of reverse proxies whose ClientIPHeader
+	// ("X-Forwarded-For", "Forwarded" or a single-address header such as
+	// "CF-Connecting-IP") is believed. With none, the client is the
+	// connection's remote address.
+	TrustedProxies []string
+	ClientIPHeader string
+
+	// settings records where each value came from, for Effective.
+	settings []*setting
 }
 
-func Load() *Config {
+// Load reads the configuration. Each setting is named after its environment
+// variable and is taken from, in increasing precedence: its default, the
+// environment (including a .env file), the YAML or TOML file given by
+// --config or KEYZY_CONFIG, and args, which are server flags such as
+// --port=8443 or --allowed-origins=https://app.keyzy.com.
+//
+// Malformed values, unknown file keys and unknown flags are errors; Validate
+// checks that the values make sense together.
+func Load(args []string) (*Config, error) {
 	// Load .env file if it exists
 	if err := godotenv.Load(); err != nil {
-		log.Printf("No .env file found or error loading it: %v", err)
-		log.Printf("Using environment variables...")
+		slog.Info("no .env file loaded; using environment variables", "err", err)
 	}
 
-	// Note: there is no server-side encryption key. Encryption is performed
-	// client-side (zero-knowledge); the server only ever stores ciphertext.
-
-	config := &Config{
-		DatabaseURL:                  getEnv("DATABASE_URL", ""),
-		FirebaseProject:              getEnv("FIREBASE_PROJECT_ID", ""),
-		GoogleApplicationCredentials: getEnv("GOOGLE_APPLICATION_CREDENTIALS", ""),
-		Port:                         getEnv("PORT", "8080"),
-		AllowedOrigins:               parseOrigins(getEnv("ALLOWED_ORIGINS", "")),
-		AllowInsecureDevAuth:         getEnv("ALLOW_INSECURE_DEV_AUTH", "") == "true",
+	l := &loader{}
+	if err := l.parseFlags(args); err != nil {
+		return nil, err
 	}
+	if err := l.readFile(); err != nil {
+		return nil, err
+	}
+	config := build(l)
+	l.checkFileKeys()
+	if err := errors.Join(l.errs...); err != nil {
+		return nil, err
+	}
+	config.settings = l.settings
 
 	if config.FirebaseProject == "your-firebase-project-id" {
-		log.Printf("Warning: Using default Firebase project ID. Set FIREBASE_PROJECT_ID environment variable.")
+		slog.Warn("using default Firebase project ID; set FIREBASE_PROJECT_ID")
 	}
 
-	return config
+	return config, nil
 }
 
-// parseOrigins splits a comma-separated ALLOWED_ORIGINS value into a trimmed list.
-func parseOrigins(raw string) []string {
+// build reads every setting through l.
+func build(l *loader) *Config {
+	// Note: there is no server-side encryption key. Encryption is performed
+	// client-side (zero-knowledge); the server only ever stores ciphertext.
+
+	return &Config{
+		DatabaseURL:                  l.string("DATABASE_URL", ""),
+		DBMaxOpenConns:               int(l.int("DB_MAX_OPEN_CONNS", 25)),
+		DBMaxIdleConns:               int(l.int("DB_MAX_IDLE_CONNS", 25)),
+		DBConnMaxLifetime:            l.duration("DB_CONN_MAX_LIFETIME", 0),
+		FirebaseProject:              l.string("FIREBASE_PROJECT_ID", ""),
+		GoogleApplicationCredentials: l.string("GOOGLE_APPLICATION_CREDENTIALS", ""),
+		Port:                         l.string("PORT", "8080"),
+		ReadHeaderTimeout:            l.duration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second),
+		ReadTimeout:                  l.duration("HTTP_READ_TIMEOUT", 10*time.Second),
+		WriteTimeout:                 l.duration("HTTP_WRITE_TIMEOUT", 15*time.Second),
+		IdleTimeout:                  l.duration("HTTP_IDLE_TIMEOUT", 60*time.Second),
+		AllowedOrigins:               l.list("ALLOWED_ORIGINS"),
+		AllowInsecureDevAuth:         l.bool("ALLOW_INSECURE_DEV_AUTH"),
+		AuthProvider:                 strings.ToLower(l.string("AUTH_PROVIDER", "firebase")),
+		OIDCIssuer:                   l.string("OIDC_ISSUER", ""),
+		OIDCAudience:                 l.string("OIDC_AUDIENCE", ""),
+		OIDCJWKSURL:                  l.string("OIDC_JWKS_URL", ""),
+		OIDCJWKSFile:                 l.string("OIDC_JWKS_FILE", ""),
+		OIDCUIDClaim:                 l.string("OIDC_UID_CLAIM", "sub"),
+		OIDCEmailClaim:               l.string("OIDC_EMAIL_CLAIM", "email"),
+		LocalAuthKeyFile:             l.string("LOCAL_AUTH_KEY_FILE", ""),
+		LocalAuthIssuer:              l.string("LOCAL_AUTH_ISSUER", "keyzy-local"),
+		LocalAuthAudience:            l.string("LOCAL_AUTH_AUDIENCE", "keyzy"),
+		BreachDatasetPath:            l.string("BREACH_DATASET_PATH", ""),
+		BreachIndexPath:              l.string("BREACH_INDEX_PATH", ""),
+		MaxEntriesPerUser:            int(l.int("MAX_ENTRIES_PER_USER", 10000)),
+		MaxBytesPerUser:              l.int("MAX_BYTES_PER_USER", 50<<20),
+		WebAuthnRPID:                 l.string("WEBAUTHN_RP_ID", ""),
+		WebAuthnRPName:               l.string("WEBAUTHN_RP_NAME", "Keyzy"),
+		WebAuthnRPOrigins:            l.list("WEBAUTHN_RP_ORIGINS"),
+		RequireSecondFactor:          l.bool("REQUIRE_SECOND_FACTOR"),
+		RequireVerifiedEmail:         l.bool("REQUIRE_VERIFIED_EMAIL"),
+		AccountDeletionGracePeriod:   l.duration("ACCOUNT_DELETION_GRACE_PERIOD", 30*24*time.Hour),
+		AdminClaim:                   l.string("ADMIN_CLAIM", ""),
+		Notifier:                     strings.ToLower(l.string("NOTIFIER", "")),
+		NotifierFile:                 l.string("NOTIFIER_FILE", "keyzy-mail.mbox"),
+		SMTPHost:                     l.string("SMTP_HOST", ""),
+		SMTPPort:                     int(l.int("SMTP_PORT", 587)),
+		SMTPUsername:                 l.string("SMTP_USERNAME", ""),
+		SMTPPassword:                 l.string("SMTP_PASSWORD", ""),
+		SMTPFrom:                     l.string("SMTP_FROM", ""),
+		LogFormat:                    l.string("LOG_FORMAT", "json"),
+		LogLevel:                     l.string("LOG_LEVEL", "info"),
+		MetricsAddr:                  l.string("METRICS_ADDR", ""),
+		TracingExporter:              l.string("TRACING_EXPORTER", ""),
+		TracingFile:                  l.string("TRACING_FILE", "keyzy-traces.jsonl"),
+		TracingSampleRatio:           l.float("TRACING_SAMPLE_RATIO", 1),
+		ShutdownDelay:                l.duration("SHUTDOWN_DELAY", 5*time.Second),
+		ShutdownTimeout:              l.duration("SHUTDOWN_TIMEOUT", 20*time.Second),
+		RateLimitStore:               l.string("RATE_LIMIT_STORE", "memory"),
+		RateLimitRedisURL:            l.string("RATE_LIMIT_REDIS_URL", ""),
+		RateLimitPolicies:            l.string("RATE_LIMIT_POLICIES", ""),
+		TrustedProxies:               l.list("TRUSTED_PROXIES"),
+		ClientIPHeader:               l.string("CLIENT_IP_HEADER", "X-Forwarded-For"),
+	}
+}
+
+// parseList splits a comma-separated value such as ALLOWED_ORIGINS into a
+// trimmed list.
+func parseList(raw string) []string {
 	var origins []string
 	for _, o := range strings.Split(raw, ",") {
 		if o = strings.TrimSpace(o); o != "" {
@@ -53,10 +216,3 @@ func parseOrigins(raw string) []string {
 	}
 	return origins
 }
-
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
-	}
-	return defaultValue
-}
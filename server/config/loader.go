@@ -0,0 +1,248 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// FileEnv names the environment variable holding the config file path when
+// --config is not given.
+const FileEnv = "KEYZY_CONFIG"
+
+// Sources of a setting's value, besides the config file's path.
+const (
+	sourceDefault = "default"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+)
+
+// setting is one value read by build, and where it came from.
+type setting struct {
+	key     string
+	value   string
+	source  string
+	boolean bool
+}
+
+// loader looks settings up in its layers and collects every malformed value,
+// so they are all reported at once.
+type loader struct {
+	flags    map[string]string
+	file     map[string]string
+	filePath string
+	settings []*setting
+	errs     []error
+	// defaultsOnly ignores every layer, for listing the settings.
+	defaultsOnly bool
+}
+
+// lookup returns the raw value of key from the highest layer that sets it.
+// Empty environment variables count as unset, as they always have; an empty
+// value in the file or a flag overrides the layers below.
+func (l *loader) lookup(key, defaultValue string, boolean bool) *setting {
+	s := &setting{key: key, value: defaultValue, source: sourceDefault, boolean: boolean}
+	l.settings = append(l.settings, s)
+	if l.defaultsOnly {
+		return s
+	}
+	if v := os.Getenv(key); v != "" {
+		s.value, s.source = v, sourceEnv
+	}
+	if v, ok := l.file[key]; ok {
+		s.value, s.source = v, l.filePath
+	}
+	if v, ok := l.flags[key]; ok {
+		s.value, s.source = v, sourceFlag
+	}
+	return s
+}
+
+func (l *loader) invalid(s *setting, want string) {
+	l.errs = append(l.errs, fmt.Errorf("%s: invalid value %q from %s: want %s", s.key, s.value, s.source, want))
+}
+
+func (l *loader) string(key, defaultValue string) string {
+	return l.lookup(key, defaultValue, false).value
+}
+
+// list splits a comma-separated value such as ALLOWED_ORIGINS. In a config
+// file it may also be written as a list.
+func (l *loader) list(key string) []string {
+	return parseList(l.lookup(key, "", false).value)
+}
+
+func (l *loader) bool(key string) bool {
+	s := l.lookup(key, "false", true)
+	value, err := strconv.ParseBool(s.value)
+	if err != nil {
+		l.invalid(s, "true or false")
+	}
+	return value
+}
+
+func (l *loader) int(key string, defaultValue int64) int64 {
+	s := l.lookup(key, strconv.FormatInt(defaultValue, 10), false)
+	value, err := strconv.ParseInt(s.value, 10, 64)
+	if err != nil || value < 0 {
+		l.invalid(s, "a non-negative integer")
+	}
+	return value
+}
+
+func (l *loader) float(key string, defaultValue float64) float64 {
+	s := l.lookup(key, strconv.FormatFloat(defaultValue, 'g', -1, 64), false)
+	value, err := strconv.ParseFloat(s.value, 64)
+	if err != nil || value < 0 {
+		l.invalid(s, "a non-negative number")
+	}
+	return value
+}
+
+func (l *loader) duration(key string, defaultValue time.Duration) time.Duration {
+	s := l.lookup(key, defaultValue.String(), false)
+	value, err := time.ParseDuration(s.value)
+	if err != nil || value < 0 {
+		l.invalid(s, "a non-negative duration such as 30s or 720h")
+	}
+	return value
+}
+
+// flagName is the command-line flag for a setting: DATABASE_URL is
+// --database-url.
+func flagName(key string) string {
+	return strings.ToLower(strings.ReplaceAll(key, "_", "-"))
+}
+
+// parseFlags reads --config and a flag for every setting from args. The
+// settings are found by running build over their defaults.
+func (l *loader) parseFlags(args []string) error {
+	fs := flag.NewFlagSet("keyzy", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.StringVar(&l.filePath, "config", os.Getenv(FileEnv), "YAML or TOML config file (env "+FileEnv+")")
+
+	l.flags = map[string]string{}
+	defaults := &loader{defaultsOnly: true}
+	build(defaults)
+	for _, s := range defaults.settings {
+		fs.Var(&flagValue{flags: l.flags, key: s.key, defaultValue: s.value, boolean: s.boolean}, flagName(s.key), "sets "+s.key)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	return nil
+}
+
+// flagValue stores a flag's raw value under its setting's key.
+type flagValue struct {
+	flags        map[string]string
+	key          string
+	defaultValue string
+	boolean      bool
+}
+
+func (f *flagValue) String() string { return f.defaultValue }
+
+func (f *flagValue) Set(value string) error {
+	f.flags[f.key] = value
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool { return f.boolean }
+
+// readFile loads the config file, if any. Its keys are the settings'
+// environment variable names, in any case, e.g.
+//
+//	port: 8443
+//	allowed_origins: [https://app.keyzy.com]
+//
+// or the same in TOML. Nested tables are not supported.
+func (l *loader) readFile() error {
+	if l.filePath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(l.filePath)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	raw := map[string]any{}
+	switch ext := strings.ToLower(filepath.Ext(l.filePath)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return fmt.Errorf("config file %s: unknown format %q: use .yaml, .yml or .toml", l.filePath, ext)
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", l.filePath, err)
+	}
+
+	l.file = map[string]string{}
+	for k, v := range raw {
+		value, err := fileValue(v)
+		if err != nil {
+			return fmt.Errorf("config file %s: %s: %w", l.filePath, k, err)
+		}
+		l.file[strings.ToUpper(k)] = value
+	}
+	return nil
+}
+
+// fileValue formats a scalar or list from the config file the way it would
+// be written in the environment.
+func fileValue(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := fileValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		return "", errors.New("nested tables are not supported")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// checkFileKeys reports keys in the config file that are not settings, which
+// are most likely typos.
+func (l *loader) checkFileKeys() {
+	known := make(map[string]bool, len(l.settings))
+	for _, s := range l.settings {
+		known[s.key] = true
+	}
+	var unknown []string
+	for key := range l.file {
+		if !known[key] {
+			unknown = append(unknown, strings.ToLower(key))
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		l.errs = append(l.errs, fmt.Errorf("config file %s: unknown setting %q", l.filePath, key))
+	}
+}
@@ -0,0 +1,224 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Validate checks that the settings are usable together, reporting every
+// problem rather than the first. Rate limit policies and trusted proxies are
+// checked where they are parsed, by ratelimit.ParsePolicies and
+// middleware.Configure.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+
+	// Database
+	if c.DatabaseURL == "" {
+		fail("DATABASE_URL", "is required")
+	} else if err := checkDatabaseURL(c.DatabaseURL); err != nil {
+		fail("DATABASE_URL", "%v", err)
+	}
+	if c.DBMaxOpenConns < 1 {
+		fail("DB_MAX_OPEN_CONNS", "must be at least 1")
+	}
+	if c.DBMaxIdleConns > c.DBMaxOpenConns {
+		fail("DB_MAX_IDLE_CONNS", "must not exceed DB_MAX_OPEN_CONNS (%d)", c.DBMaxOpenConns)
+	}
+
+	// HTTP server
+	if err := checkPort(c.Port); err != nil {
+		fail("PORT", "%v", err)
+	}
+	for _, t := range []struct {
+		key string
+		d   time.Duration
+	}{
+		{"HTTP_READ_HEADER_TIMEOUT", c.ReadHeaderTimeout},
+		{"HTTP_READ_TIMEOUT", c.ReadTimeout},
+		{"HTTP_WRITE_TIMEOUT", c.WriteTimeout},
+		{"HTTP_IDLE_TIMEOUT", c.IdleTimeout},
+		{"SHUTDOWN_TIMEOUT", c.ShutdownTimeout},
+	} {
+		if t.d == 0 {
+			fail(t.key, "must be greater than zero")
+		}
+	}
+	if c.ReadTimeout != 0 && c.ReadHeaderTimeout > c.ReadTimeout {
+		fail("HTTP_READ_HEADER_TIMEOUT", "must not exceed HTTP_READ_TIMEOUT (%s)", c.ReadTimeout)
+	}
+
+	// CORS and WebAuthn origins
+	for _, o := range c.AllowedOrigins {
+		if err := checkOrigin(o); err != nil {
+			fail("ALLOWED_ORIGINS", "%v", err)
+		}
+	}
+	for _, o := range c.WebAuthnRPOrigins {
+		if err := checkOrigin(o); err != nil {
+			fail("WEBAUTHN_RP_ORIGINS", "%v", err)
+		}
+	}
+	if c.WebAuthnRPID != "" && len(c.WebAuthnRPOrigins) == 0 {
+		fail("WEBAUTHN_RP_ORIGINS", "is required when WEBAUTHN_RP_ID is set")
+	}
+
+	// Auth provider
+	switch c.AuthProvider {
+	case "", "firebase":
+	case "oidc":
+		if c.OIDCIssuer == "" {
+			fail("OIDC_ISSUER", "is required when AUTH_PROVIDER=oidc")
+		} else if err := checkHTTPURL(c.OIDCIssuer); err != nil {
+			fail("OIDC_ISSUER", "%v", err)
+		}
+		if c.OIDCAudience == "" {
+			fail("OIDC_AUDIENCE", "is required when AUTH_PROVIDER=oidc")
+		}
+		if c.OIDCJWKSURL != "" {
+			if err := checkHTTPURL(c.OIDCJWKSURL); err != nil {
+				fail("OIDC_JWKS_URL", "%v", err)
+			}
+		}
+	case "local":
+	default:
+		fail("AUTH_PROVIDER", "unknown provider %q: use firebase, oidc or local", c.AuthProvider)
+	}
+
+	// Notifications
+	switch c.Notifier {
+	case "", "file":
+	case "smtp":
+		if c.SMTPHost == "" {
+			fail("SMTP_HOST", "is required when NOTIFIER=smtp")
+		}
+		if c.SMTPFrom == "" {
+			fail("SMTP_FROM", "is required when NOTIFIER=smtp")
+		}
+	default:
+		fail("NOTIFIER", "unknown notifier %q: use smtp, file or leave it empty", c.Notifier)
+	}
+	if c.SMTPPort < 1 || c.SMTPPort > 65535 {
+		fail("SMTP_PORT", "must be between 1 and 65535")
+	}
+
+	// Observability
+	switch strings.ToLower(c.LogFormat) {
+	case "json", "text":
+	default:
+		fail("LOG_FORMAT", "unknown format %q: use json or text", c.LogFormat)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		fail("LOG_LEVEL", "unknown level %q: use debug, info, warn or error", c.LogLevel)
+	}
+	switch c.TracingExporter {
+	case "", "otlp", "stdout":
+	case "file":
+		if c.TracingFile == "" {
+			fail("TRACING_FILE", "is required when TRACING_EXPORTER=file")
+		}
+	default:
+		fail("TRACING_EXPORTER", "unknown exporter %q: use otlp, stdout, file or leave it empty", c.TracingExporter)
+	}
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1 {
+		fail("TRACING_SAMPLE_RATIO", "must be between 0 and 1")
+	}
+
+	// Rate limits
+	switch c.RateLimitStore {
+	case "", "memory", "postgres":
+	case "redis":
+		if c.RateLimitRedisURL == "" {
+			fail("RATE_LIMIT_REDIS_URL", "is required when RATE_LIMIT_STORE=redis")
+		} else if err := checkRedisURL(c.RateLimitRedisURL); err != nil {
+			fail("RATE_LIMIT_REDIS_URL", "%v", err)
+		}
+	default:
+		fail("RATE_LIMIT_STORE", "unknown store %q: use memory, postgres or redis", c.RateLimitStore)
+	}
+
+	return errors.Join(errs...)
+}
+
+// parseURL is url.Parse without the URL in its error, which may hold a
+// password.
+func parseURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if urlErr, ok := err.(*url.Error); ok {
+		return nil, urlErr.Err
+	}
+	return u, err
+}
+
+// checkDatabaseURL accepts a postgres:// URL or a key=value connection
+// string, the forms lib/pq understands.
+func checkDatabaseURL(raw string) error {
+	if !strings.Contains(raw, "://") {
+		if !strings.Contains(raw, "=") {
+			return errors.New("want a postgres:// URL or a key=value connection string")
+		}
+		return nil
+	}
+	u, err := parseURL(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return fmt.Errorf("unsupported scheme %q: use postgres://", u.Scheme)
+	}
+	return nil
+}
+
+func checkRedisURL(raw string) error {
+	u, err := parseURL(raw)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "redis", "rediss", "unix":
+		return nil
+	default:
+		return fmt.Errorf("unsupported scheme %q: use redis://, rediss:// or unix://", u.Scheme)
+	}
+}
+
+func checkPort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("invalid port %q: want a number between 1 and 65535", port)
+	}
+	return nil
+}
+
+func checkHTTPURL(raw string) error {
+	u, err := parseURL(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid URL %q: want an absolute http(s) URL", raw)
+	}
+	return nil
+}
+
+// checkOrigin accepts an origin as browsers send it: scheme://host[:port],
+// with no path, query or trailing slash. Anything else would never match
+// the Origin header.
+func checkOrigin(origin string) error {
+	u, err := parseURL(origin)
+	if err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "" &&
+		u.User == nil && u.Path == "" && u.RawQuery == "" && u.Fragment == "" && !u.ForceQuery {
+		if port := u.Port(); port == "" || checkPort(port) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid origin %q: want scheme://host[:port], e.g. https://app.keyzy.com", origin)
+}
@@ -1,35 +1,48 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
+	"strconv"
 	"strings"
 
+	"password-manager/config"
+
+	"github.com/XSAM/otelsql"
 	_ "github.com/lib/pq"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
-func Connect(databaseURL string) (*sql.DB, error) {
+// Connect opens the database at cfg.DatabaseURL with the configured pool
+// limits and checks that it is reachable.
+func Connect(cfg *config.Config) (*sql.DB, error) {
 	// Vaults are encrypted, but the connection still carries auth tokens and
 	// metadata. Warn loudly if the DB link is not using TLS.
-	if strings.Contains(databaseURL, "sslmode=disable") {
-		log.Printf("WARNING: database connection has sslmode=disable — use sslmode=require (or verify-full) in production")
+	if strings.Contains(cfg.DatabaseURL, "sslmode=disable") {
+		slog.Warn("database connection has sslmode=disable — use sslmode=require (or verify-full) in production")
 	}
 
-	db, err := sql.Open("postgres", databaseURL)
+	// Every query gets a span under the caller's context.
+	db, err := otelsql.Open("postgres", cfg.DatabaseURL,
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{OmitConnResetSession: true, OmitRows: true}),
+	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
+	// Set connection pool settings
+	db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	db.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	db.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+
 	// Test the connection
 	if err := db.Ping(); err != nil {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	// Set connection pool settings
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(25)
-
 	return db, nil
 }
 
@@ -100,6 +113,299 @@ var migrations = []migration{
 			ALTER TABLE password_entries DROP COLUMN IF EXISTS notes;
 		`,
 	},
+	{
+		// Client-supplied vault health metadata. password_fingerprint is an HMAC
+		// of the password under a key derived from the DEK, so equal values only
+		// reveal reuse within a single vault. strength_bucket is a 0-4 score.
+		// password_updated_at tracks the age of the secret itself, independent of
+		// label or note edits.
+		name: "004_entry_health",
+		stmt: `
+			ALTER TABLE password_entries ADD COLUMN IF NOT EXISTS password_fingerprint TEXT;
+			ALTER TABLE password_entries ADD COLUMN IF NOT EXISTS strength_bucket SMALLINT;
+			ALTER TABLE password_entries ADD COLUMN IF NOT EXISTS password_updated_at TIMESTAMP;
+			UPDATE password_entries SET password_updated_at = COALESCE(updated_at, created_at, NOW());
+			ALTER TABLE password_entries ALTER COLUMN password_updated_at SET DEFAULT NOW();
+			CREATE INDEX IF NOT EXISTS idx_password_entries_fingerprint ON password_entries(user_id, password_fingerprint);
+		`,
+	},
+	{
+		// Server-side revocation: tokens issued before tokens_valid_after are
+		// rejected. TIMESTAMPTZ because it is compared with token iat claims,
+		// which are absolute times.
+		name: "005_tokens_valid_after",
+		stmt: `
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS tokens_valid_after TIMESTAMPTZ;
+		`,
+	},
+	{
+		// Devices seen on authenticated requests, keyed by a client-generated
+		// device ID. A revoked device is kept (not deleted) so that its
+		// requests keep being rejected. device_logins records each new
+		// sign-in (a newer auth_time) from a device.
+		name: "006_devices",
+		stmt: `
+			CREATE TABLE IF NOT EXISTS devices (
+				id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				device_id VARCHAR(128) NOT NULL,
+				user_agent VARCHAR(512),
+				last_ip VARCHAR(64),
+				last_auth_time TIMESTAMPTZ,
+				first_seen TIMESTAMP DEFAULT NOW(),
+				last_seen TIMESTAMP DEFAULT NOW(),
+				revoked_at TIMESTAMP,
+				UNIQUE (user_id, device_id)
+			);
+
+			CREATE TABLE IF NOT EXISTS device_logins (
+				id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+				device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+				auth_time TIMESTAMPTZ NOT NULL,
+				ip VARCHAR(64),
+				user_agent VARCHAR(512),
+				created_at TIMESTAMP DEFAULT NOW()
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_device_logins_device_id ON device_logins(device_id, created_at);
+		`,
+	},
+	{
+		// Personal access tokens for scripts and CI. Only a SHA-256 of the
+		// token is stored; token_hint is its non-secret prefix for display.
+		name: "007_access_tokens",
+		stmt: `
+			CREATE TABLE IF NOT EXISTS access_tokens (
+				id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				name VARCHAR(100) NOT NULL,
+				token_hash BYTEA UNIQUE NOT NULL,
+				token_hint VARCHAR(32) NOT NULL,
+				scopes TEXT[] NOT NULL,
+				expires_at TIMESTAMPTZ,
+				last_used_at TIMESTAMPTZ,
+				created_at TIMESTAMPTZ DEFAULT NOW()
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_access_tokens_user_id ON access_tokens(user_id);
+		`,
+	},
+	{
+		// Second factors. totp_secret is set at enrolment and only counts
+		// once totp_enabled_at is set by a confirmed code; totp_last_step
+		// stops a code being replayed within its window.
+		name: "008_second_factor",
+		stmt: `
+			ALTER TABLE users
+				ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64),
+				ADD COLUMN IF NOT EXISTS totp_enabled_at TIMESTAMPTZ,
+				ADD COLUMN IF NOT EXISTS totp_last_step BIGINT,
+				ADD COLUMN IF NOT EXISTS mfa_failed_attempts INTEGER NOT NULL DEFAULT 0,
+				ADD COLUMN IF NOT EXISTS mfa_locked_until TIMESTAMPTZ;
+
+			CREATE TABLE IF NOT EXISTS recovery_codes (
+				id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				code_hash BYTEA NOT NULL,
+				used_at TIMESTAMPTZ,
+				created_at TIMESTAMPTZ DEFAULT NOW(),
+				UNIQUE(user_id, code_hash)
+			);
+
+			CREATE TABLE IF NOT EXISTS webauthn_credentials (
+				id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				name VARCHAR(100) NOT NULL,
+				credential_id BYTEA UNIQUE NOT NULL,
+				credential JSONB NOT NULL,
+				last_used_at TIMESTAMPTZ,
+				created_at TIMESTAMPTZ DEFAULT NOW()
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_user_id ON webauthn_credentials(user_id);
+
+			CREATE TABLE IF NOT EXISTS webauthn_sessions (
+				id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				ceremony VARCHAR(16) NOT NULL,
+				session JSONB NOT NULL,
+				expires_at TIMESTAMPTZ NOT NULL
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_webauthn_sessions_user_id ON webauthn_sessions(user_id);
+
+			CREATE TABLE IF NOT EXISTS step_up_tokens (
+				token_hash BYTEA PRIMARY KEY,
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				expires_at TIMESTAMPTZ NOT NULL
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_step_up_tokens_user_id ON step_up_tokens(user_id);
+		`,
+	},
+	{
+		// Optional server-side check of the master password: an Argon2id
+		// hash of an auth hash the client derives from its master key.
+		// Failed attempts are counted per account to lock out guessing.
+		name: "009_vault_auth_hash",
+		stmt: `
+			ALTER TABLE users
+				ADD COLUMN IF NOT EXISTS vault_auth_hash TEXT,
+				ADD COLUMN IF NOT EXISTS vault_auth_failed_attempts INTEGER NOT NULL DEFAULT 0,
+				ADD COLUMN IF NOT EXISTS vault_auth_locked_until TIMESTAMPTZ;
+		`,
+	},
+	{
+		// Account status, enforced by the auth middleware on every request.
+		name: "010_user_status",
+		stmt: `
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS status VARCHAR(32) NOT NULL DEFAULT 'active'
+				CHECK (status IN ('active', 'suspended', 'pending_deletion'));
+		`,
+	},
+	{
+		// Accounts in pending_deletion are purged once deletion_scheduled_at
+		// has passed.
+		name: "011_account_deletion",
+		stmt: `
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_scheduled_at TIMESTAMPTZ;
+			CREATE INDEX IF NOT EXISTS idx_users_deletion_scheduled_at
+				ON users(deletion_scheduled_at) WHERE status = 'pending_deletion';
+		`,
+	},
+	{
+		// Operator role, and the audit log that records every action taken
+		// through the admin API. user_id has no foreign key so history
+		// survives the account being purged.
+		name: "012_admin",
+		stmt: `
+			ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(32) NOT NULL DEFAULT 'user'
+				CHECK (role IN ('user', 'admin'));
+
+			CREATE TABLE IF NOT EXISTS audit_events (
+				id BIGSERIAL PRIMARY KEY,
+				actor_uid VARCHAR(255),
+				user_id UUID,
+				action VARCHAR(64) NOT NULL,
+				target_type VARCHAR(32),
+				target_id VARCHAR(255),
+				ip VARCHAR(64),
+				user_agent TEXT,
+				details JSONB,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON audit_events(created_at);
+		`,
+	},
+	{
+		// Security events, written by handlers and the auth middleware,
+		// share the audit log; each user can list their own.
+		name: "013_audit_events",
+		stmt: `
+			CREATE INDEX IF NOT EXISTS idx_audit_events_user_id ON audit_events(user_id, id);
+		`,
+	},
+	{
+		// Hash-chain audit events. details becomes text so the hashed
+		// bytes are exactly the stored ones (jsonb rewrites them). Events are
+		// written without a seq and chained, existing ones included, by
+		// audit.Seal, which numbers them in the order they committed.
+		name: "014_audit_chain",
+		stmt: `
+			ALTER TABLE audit_events ALTER COLUMN details TYPE TEXT USING details::text;
+			ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS seq BIGINT UNIQUE;
+			ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS prev_hash BYTEA;
+			ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS user_prev_hash BYTEA;
+			ALTER TABLE audit_events ADD COLUMN IF NOT EXISTS hash BYTEA;
+
+			CREATE INDEX IF NOT EXISTS idx_audit_events_user_seq ON audit_events(user_id, seq);
+			CREATE INDEX IF NOT EXISTS idx_audit_events_unsealed ON audit_events(id) WHERE seq IS NULL;
+		`,
+	},
+	{
+		// Outbox of rendered notification emails, sent by
+		// jobs.OutboxSender. Rows are written in the transaction of the
+		// change they report, so a crash cannot lose them. While being sent
+		// a row is 'sending', leased until next_attempt_at.
+		name: "015_notification_outbox",
+		stmt: `
+			CREATE TABLE IF NOT EXISTS notification_outbox (
+				id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+				user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+				recipient VARCHAR(255) NOT NULL,
+				kind VARCHAR(64) NOT NULL,
+				subject TEXT NOT NULL,
+				body TEXT NOT NULL,
+				status VARCHAR(16) NOT NULL DEFAULT 'pending'
+					CHECK (status IN ('pending', 'sending', 'sent', 'failed', 'skipped')),
+				attempts INTEGER NOT NULL DEFAULT 0,
+				last_error TEXT,
+				next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+				sent_at TIMESTAMPTZ,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_notification_outbox_due
+				ON notification_outbox(next_attempt_at) WHERE status IN ('pending', 'sending');
+			CREATE INDEX IF NOT EXISTS idx_notification_outbox_user_kind
+				ON notification_outbox(user_id, kind, created_at);
+		`,
+	},
+	{
+		// Rate limit state shared by replicas, each key's GCRA
+		// theoretical arrival time. Unlogged, since losing it in a crash
+		// only resets the limits.
+		name: "016_rate_limit_buckets",
+		stmt: `
+			CREATE UNLOGGED TABLE IF NOT EXISTS rate_limit_buckets (
+				key TEXT PRIMARY KEY,
+				tat TIMESTAMPTZ NOT NULL
+			);
+
+			CREATE INDEX IF NOT EXISTS idx_rate_limit_buckets_tat ON rate_limit_buckets(tat);
+		`,
+	},
+}
+
+// SchemaVersion returns the number of the latest applied migration, e.g. 15
+// for 015_notification_outbox.
+func SchemaVersion(db *sql.DB) (int, error) {
+	var name string
+	if err := db.QueryRow(`SELECT name FROM schema_migrations ORDER BY name DESC LIMIT 1`).Scan(&name); err != nil {
+		return 0, err
+	}
+	prefix, _, _ := strings.Cut(name, "_")
+	return strconv.Atoi(prefix)
+}
+
+// PendingMigrations returns the names of migrations this build knows about
+// that have not been applied.
+func PendingMigrations(ctx context.Context, db *sql.DB) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT name FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		applied[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var pending []string
+	for _, m := range migrations {
+		if !applied[m.name] {
+			pending = append(pending, m.name)
+		}
+	}
+	return pending, nil
 }
 
 func RunMigrations(db *sql.DB) error {
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"password-manager/audit"
+	"password-manager/middleware"
+	"password-manager/models"
+)
+
+// recentAuthWindow is how recently the user must have signed in (not just
+// refreshed a token) to delete their account or give their vault its first
+// auth hash.
+const recentAuthWindow = 5 * time.Minute
+
+// requireRecentAuth writes a 403 asking the user to sign in again, to do
+// what action describes, unless they did so within recentAuthWindow.
+func requireRecentAuth(w http.ResponseWriter, r *http.Request, action string) bool {
+	if authTime := middleware.GetAuthTime(r); !authTime.IsZero() && time.Since(authTime) <= recentAuthWindow {
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(models.ErrorResponse{
+		Error: "Sign in again to " + action,
+		Code:  "recent_auth_required",
+	})
+	return false
+}
+
+type AccountHandler struct {
+	db          *sql.DB
+	auth        *middleware.Authenticator
+	gracePeriod time.Duration
+}
+
+func NewAccountHandler(db *sql.DB, auth *middleware.Authenticator, gracePeriod time.Duration) *AccountHandler {
+	return &AccountHandler{db: db, auth: auth, gracePeriod: gracePeriod}
+}
+
+// DeleteAccount schedules the account for deletion after the grace period.
+// Until then the account is locked to everything except viewing its profile
+// and cancelling the deletion; afterwards the purge job removes it along
+// with the identity-provider account.
+func (h *AccountHandler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// A stolen or long-lived session must not be enough to delete an
+	// account; ask the user to sign in again first.
+	if !requireRecentAuth(w, r, "delete your account") {
+		return
+	}
+
+	deletion := models.AccountDeletion{Status: middleware.StatusPendingDeletion}
+	err := h.db.QueryRowContext(r.Context(), `
+		UPDATE users
+		SET status = $1, deletion_scheduled_at = NOW() + $2 * INTERVAL '1 second', updated_at = NOW()
+		WHERE firebase_uid = $3 AND status = $4
+		RETURNING deletion_scheduled_at
+	`, middleware.StatusPendingDeletion, int64(h.gracePeriod.Seconds()), firebaseUID, middleware.StatusActive).Scan(&deletion.ScheduledAt)
+	if err == sql.ErrNoRows {
+		// The middleware only lets active accounts through, so the user
+		// has not registered.
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	h.auth.ForgetAccount(firebaseUID)
+	recordEvent(h.db, r, middleware.AuditEvent(r, audit.ActionDeletionScheduled))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "Account scheduled for deletion",
+		Data:    deletion,
+	})
+}
+
+// CancelDeletion restores an account that is pending deletion.
+func (h *AccountHandler) CancelDeletion(w http.ResponseWriter, r *http.Request) {
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	result, err := h.db.ExecContext(r.Context(), `
+		UPDATE users
+		SET status = $1, deletion_scheduled_at = NULL, updated_at = NOW()
+		WHERE firebase_uid = $2 AND status = $3
+	`, middleware.StatusActive, firebaseUID, middleware.StatusPendingDeletion)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if rowsAffected == 0 {
+		http.Error(w, "Account is not pending deletion", http.StatusConflict)
+		return
+	}
+	h.auth.ForgetAccount(firebaseUID)
+	recordEvent(h.db, r, middleware.AuditEvent(r, audit.ActionDeletionCancelled))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "Account deletion cancelled",
+		Data:    models.AccountDeletion{Status: middleware.StatusActive},
+	})
+}
@@ -0,0 +1,484 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"password-manager/audit"
+	"password-manager/metrics"
+	"password-manager/middleware"
+	"password-manager/models"
+	"password-manager/notify"
+	"password-manager/utils"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// adminUserColumns selects an AdminUser. It must never include key material
+// or ciphertext; entry sizes are aggregated in the lateral join.
+const adminUserColumns = `
+	u.id, u.firebase_uid, u.email, u.status, u.role,
+	u.wrapped_vault_key IS NOT NULL,
+	u.totp_enabled_at IS NOT NULL OR EXISTS (SELECT 1 FROM webauthn_credentials c WHERE c.user_id = u.id),
+	e.entries, e.bytes,
+	u.deletion_scheduled_at, u.created_at, u.updated_at
+FROM users u
+CROSS JOIN LATERAL (
+	SELECT COUNT(*) AS entries, COALESCE(SUM(` + entryBytes + `), 0) AS bytes
+	FROM password_entries WHERE user_id = u.id
+) e`
+
+func adminUserFields(u *models.AdminUser) []interface{} {
+	return []interface{}{
+		&u.ID, &u.FirebaseUID, &u.Email, &u.Status, &u.Role,
+		&u.VaultInitialized, &u.SecondFactor, &u.Entries, &u.Bytes,
+		&u.DeletionScheduledAt, &u.CreatedAt, &u.UpdatedAt,
+	}
+}
+
+// AdminHandler serves the operator API. Every request, including reads, is
+// audited.
+type AdminHandler struct {
+	db   *sql.DB
+	auth *middleware.Authenticator
+}
+
+func NewAdminHandler(db *sql.DB, auth *middleware.Authenticator) *AdminHandler {
+	return &AdminHandler{db: db, auth: auth}
+}
+
+// ListUsers lists accounts, newest first, optionally filtered by a
+// case-insensitive email substring (?email=), with ?limit= and ?offset=.
+func (h *AdminHandler) ListUsers(w http.ResponseWriter, r *http.Request) {
+	limit, offset, ok := parsePage(w, r.URL.Query())
+	if !ok {
+		return
+	}
+	email := r.URL.Query().Get("email")
+
+	rows, err := h.db.QueryContext(r.Context(), `
+		SELECT `+adminUserColumns+`
+		WHERE $1::text = '' OR u.email ILIKE '%' || $1::text || '%' ESCAPE '\'
+		ORDER BY u.created_at DESC
+		LIMIT $2 OFFSET $3
+	`, escapeLike(email), limit, offset)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	defer rows.Close()
+
+	users := []models.AdminUser{}
+	for rows.Next() {
+		var u models.AdminUser
+		if err := rows.Scan(adminUserFields(&u)...); err != nil {
+			serverError(w, r, "Database error", err)
+			return
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if err := recordAdminAction(h.db, r, audit.ActionAdminListUsers, nil, map[string]interface{}{
+		"email": email, "limit": limit, "offset": offset,
+	}); err != nil {
+		serverError(w, r, "Failed to record admin action", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "Users retrieved successfully",
+		Data:    users,
+	})
+}
+
+// GetUser returns one account with its usage.
+func (h *AdminHandler) GetUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var u models.AdminUser
+	err = h.db.QueryRowContext(r.Context(), `SELECT `+adminUserColumns+` WHERE u.id = $1`, userID).Scan(adminUserFields(&u)...)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if err := recordAdminAction(h.db, r, audit.ActionAdminViewUser, &userID, nil); err != nil {
+		serverError(w, r, "Failed to record admin action", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "User retrieved successfully",
+		Data:    u,
+	})
+}
+
+// SuspendUser blocks an active account. Its tokens and access tokens stop
+// working from the next request; its data is kept.
+func (h *AdminHandler) SuspendUser(w http.ResponseWriter, r *http.Request) {
+	h.setStatus(w, r, audit.ActionAdminSuspend, middleware.StatusSuspended,
+		[]string{middleware.StatusActive}, "User suspended successfully")
+}
+
+// ReactivateUser restores a suspended account, or one pending deletion.
+func (h *AdminHandler) ReactivateUser(w http.ResponseWriter, r *http.Request) {
+	h.setStatus(w, r, audit.ActionAdminReactivate, middleware.StatusActive,
+		[]string{middleware.StatusSuspended, middleware.StatusPendingDeletion}, "User reactivated successfully")
+}
+
+// setStatus moves the target account to status if it is currently in one of
+// from, recording the action in the same transaction.
+func (h *AdminHandler) setStatus(w http.ResponseWriter, r *http.Request, action, status string, from []string, message string) {
+	userID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	req, ok := decodeAdminAction(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var firebaseUID, current string
+	err = tx.QueryRowContext(r.Context(), `
+		SELECT firebase_uid, status FROM users WHERE id = $1 FOR UPDATE
+	`, userID).Scan(&firebaseUID, &current)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if firebaseUID == middleware.GetFirebaseUID(r) {
+		http.Error(w, "Admins cannot change their own status", http.StatusBadRequest)
+		return
+	}
+	if !slices.Contains(from, current) {
+		http.Error(w, "User is "+current, http.StatusConflict)
+		return
+	}
+
+	if _, err := tx.ExecContext(r.Context(), `
+		UPDATE users
+		SET status = $1, deletion_scheduled_at = NULL, updated_at = NOW()
+		WHERE id = $2
+	`, status, userID); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if err := recordAdminAction(tx, r, action, &userID, map[string]interface{}{
+		"reason": req.Reason, "from": current, "to": status,
+	}); err != nil {
+		serverError(w, r, "Failed to record admin action", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	h.auth.ForgetAccount(firebaseUID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: message,
+	})
+}
+
+// ResetVault wipes a user's vault so they can start over after losing their
+// master password: the key material and auth hash are cleared and every
+// entry, which nobody can decrypt any more, is deleted.
+func (h *AdminHandler) ResetVault(w http.ResponseWriter, r *http.Request) {
+	userID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	req, ok := decodeAdminAction(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(r.Context(), `
+		UPDATE users
+		SET kdf_salt = NULL, wrapped_vault_key = NULL, master_password_hint = NULL,
+			vault_auth_hash = NULL, vault_auth_failed_attempts = 0, vault_auth_locked_until = NULL,
+			updated_at = NOW()
+		WHERE id = $1
+	`, userID)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if n == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	result, err = tx.ExecContext(r.Context(), `DELETE FROM password_entries WHERE user_id = $1`, userID)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if err := recordAdminAction(tx, r, audit.ActionAdminResetVault, &userID, map[string]interface{}{
+		"reason": req.Reason, "entries_deleted": deleted,
+	}); err != nil {
+		serverError(w, r, "Failed to record admin action", err)
+		return
+	}
+	if err := notify.Enqueue(r.Context(), tx, userID, notify.KindVaultReset, map[string]string{
+		"Time": notify.FormatTime(time.Now()),
+	}); err != nil {
+		serverError(w, r, "Failed to queue notification", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	metrics.EntriesDeleted.Add(float64(deleted))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "Vault reset successfully",
+	})
+}
+
+// GetStats reports instance-wide counts.
+func (h *AdminHandler) GetStats(w http.ResponseWriter, r *http.Request) {
+	stats := models.InstanceStats{UsersByStatus: map[string]int{}}
+
+	rows, err := h.db.QueryContext(r.Context(), `SELECT status, COUNT(*) FROM users GROUP BY status`)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			status string
+			count  int
+		)
+		if err := rows.Scan(&status, &count); err != nil {
+			serverError(w, r, "Database error", err)
+			return
+		}
+		stats.UsersByStatus[status] = count
+		stats.Users += count
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	err = h.db.QueryRowContext(r.Context(), `
+		SELECT
+			(SELECT COUNT(*) FROM users WHERE role = 'admin'),
+			(SELECT COUNT(*) FROM users WHERE wrapped_vault_key IS NOT NULL),
+			(SELECT COUNT(*) FROM users u WHERE u.totp_enabled_at IS NOT NULL
+				OR EXISTS (SELECT 1 FROM webauthn_credentials c WHERE c.user_id = u.id)),
+			(SELECT COUNT(*) FROM password_entries),
+			(SELECT COALESCE(SUM(`+entryBytes+`), 0) FROM password_entries),
+			(SELECT COUNT(*) FROM access_tokens),
+			(SELECT COUNT(*) FROM devices)
+	`).Scan(&stats.Admins, &stats.VaultsInitialized, &stats.SecondFactorUsers,
+		&stats.Entries, &stats.Bytes, &stats.AccessTokens, &stats.Devices)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if err := recordAdminAction(h.db, r, audit.ActionAdminViewStats, nil, nil); err != nil {
+		serverError(w, r, "Failed to record admin action", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "Instance stats retrieved successfully",
+		Data:    stats,
+	})
+}
+
+// ExportEvents streams audit events across all users as newline-delimited
+// JSON, newest first. It accepts the filters of GET /api/user/events plus
+// ?user_id=, without paging.
+func (h *AdminHandler) ExportEvents(w http.ResponseWriter, r *http.Request) {
+	filter, ok := parseEventFilter(w, r.URL.Query())
+	if !ok {
+		return
+	}
+	if raw := r.URL.Query().Get("user_id"); raw != "" {
+		userID, err := uuid.Parse(raw)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		filter.UserID = &userID
+	}
+
+	details := map[string]interface{}{}
+	if len(filter.Actions) > 0 {
+		details["actions"] = filter.Actions
+	}
+	if !filter.Since.IsZero() {
+		details["since"] = filter.Since
+	}
+	if !filter.Until.IsZero() {
+		details["until"] = filter.Until
+	}
+	if err := recordAdminAction(h.db, r, audit.ActionAdminExportEvents, filter.UserID, details); err != nil {
+		serverError(w, r, "Failed to record admin action", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	err := audit.List(r.Context(), h.db, filter, func(e models.AuditEvent) error {
+		return enc.Encode(e)
+	})
+	if err != nil {
+		// The status line is already sent; a truncated stream is all the
+		// client can be told.
+		slog.ErrorContext(r.Context(), "audit export failed", "err", err)
+	}
+}
+
+// VerifyAudit walks the audit chain and reports the first broken link, if
+// any.
+func (h *AdminHandler) VerifyAudit(w http.ResponseWriter, r *http.Request) {
+	if err := recordAdminAction(h.db, r, audit.ActionAdminVerifyAudit, nil, nil); err != nil {
+		serverError(w, r, "Failed to record admin action", err)
+		return
+	}
+	result, err := audit.Verify(r.Context(), h.db)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	message := "Audit chain verified"
+	if result.Broken != nil {
+		message = "Audit chain is broken"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: message,
+		Data:    result,
+	})
+}
+
+// GetAuditHead returns the latest audit event's ID and hash, for recording
+// with an external notary. The request is audited and sealed first, so the
+// head is the record of this export.
+func (h *AdminHandler) GetAuditHead(w http.ResponseWriter, r *http.Request) {
+	if err := recordAdminAction(h.db, r, audit.ActionAdminAuditHead, nil, nil); err != nil {
+		serverError(w, r, "Failed to record admin action", err)
+		return
+	}
+	if _, err := audit.Seal(r.Context(), h.db); err != nil {
+		serverError(w, r, "Failed to seal audit log", err)
+		return
+	}
+	head, err := audit.Head(r.Context(), h.db)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "Audit chain head retrieved successfully",
+		Data:    head,
+	})
+}
+
+// recordAdminAction audits an admin action on target, or on no one in
+// particular when target is nil. Mutations call it inside their transaction
+// so neither the change nor its record can exist alone.
+func recordAdminAction(q audit.Querier, r *http.Request, action string, target *uuid.UUID, details map[string]interface{}) error {
+	e := middleware.AuditEvent(r, action)
+	if target != nil {
+		e.UserID = target
+		e.TargetType = "user"
+		e.TargetID = target.String()
+	}
+	e.Details = details
+	return audit.Record(r.Context(), q, e)
+}
+
+// decodeAdminAction reads the optional AdminActionRequest body.
+func decodeAdminAction(w http.ResponseWriter, r *http.Request) (models.AdminActionRequest, bool) {
+	var req models.AdminActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return req, false
+	}
+	if err := utils.Validate(&req); err != nil {
+		http.Error(w, "Invalid input: "+err.Error(), http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+// queryInt parses an optional integer query parameter.
+func queryInt(raw string, defaultValue int) (int, error) {
+	if raw == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(raw)
+}
+
+// escapeLike escapes LIKE wildcards so user input matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
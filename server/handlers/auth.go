@@ -1,10 +1,12 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"net/http"
 
+	"password-manager/audit"
 	"password-manager/middleware"
 	"password-manager/models"
 )
@@ -20,33 +22,55 @@ func NewAuthHandler(db *sql.DB) *AuthHandler {
 // Register creates a new user in our database after Firebase authentication.
 // The identity is taken from the *verified* Firebase token (populated by
 // AuthMiddleware), never from the request body — so a caller cannot register
-// or impersonate an arbitrary UID/email.
+// or impersonate an arbitrary UID/email. The email is only stored once the
+// provider has verified it, since security notifications go to it and admins
+// search by it. Calling it again for an existing user refreshes the stored
+// email from the token.
 func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 	firebaseUID := middleware.GetFirebaseUID(r)
 	if firebaseUID == "" {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	email := middleware.GetUserEmail(r)
+	var email string
+	if middleware.EmailVerified(r) {
+		email = middleware.GetUserEmail(r)
+	}
 
 	// Check if user already exists
 	var existingUser models.User
-	err := h.db.QueryRow(`
-		SELECT id, firebase_uid, email, created_at, updated_at
+	err := h.db.QueryRowContext(r.Context(), `
+		SELECT id, firebase_uid, email, status, created_at, updated_at
 		FROM users WHERE firebase_uid = $1
 	`, firebaseUID).Scan(
 		&existingUser.ID,
 		&existingUser.FirebaseUID,
 		&existingUser.Email,
+		&existingUser.Status,
 		&existingUser.CreatedAt,
 		&existingUser.UpdatedAt,
 	)
 
 	if err == nil {
-		// User already exists, return existing user
+		// User already exists. Pick up an email address changed at the
+		// identity provider, then return the user.
+		message := "User already exists"
+		if email != "" && email != existingUser.Email {
+			err = h.db.QueryRowContext(r.Context(), `
+				UPDATE users SET email = $1, updated_at = NOW()
+				WHERE id = $2
+				RETURNING email, updated_at
+			`, email, existingUser.ID).Scan(&existingUser.Email, &existingUser.UpdatedAt)
+			if err != nil {
+				serverError(w, r, "Failed to update user", err)
+				return
+			}
+			message = "User email updated"
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(models.SuccessResponse{
-			Message: "User already exists",
+			Message: message,
 			Data:    existingUser,
 		})
 		return
@@ -54,28 +78,30 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 
 	if err != sql.ErrNoRows {
 		// Database error
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		serverError(w, r, "Database error", err)
 		return
 	}
 
 	// Create new user
 	var newUser models.User
-	err = h.db.QueryRow(`
+	err = h.db.QueryRowContext(r.Context(), `
 		INSERT INTO users (firebase_uid, email)
 		VALUES ($1, $2)
-		RETURNING id, firebase_uid, email, created_at, updated_at
+		RETURNING id, firebase_uid, email, status, created_at, updated_at
 	`, firebaseUID, email).Scan(
 		&newUser.ID,
 		&newUser.FirebaseUID,
 		&newUser.Email,
+		&newUser.Status,
 		&newUser.CreatedAt,
 		&newUser.UpdatedAt,
 	)
 
 	if err != nil {
-		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		serverError(w, r, "Failed to create user", err)
 		return
 	}
+	recordEvent(h.db, r, middleware.AuditEvent(r, audit.ActionRegistered))
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -94,13 +120,15 @@ func (h *AuthHandler) GetProfile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var user models.User
-	err := h.db.QueryRow(`
-		SELECT id, firebase_uid, email, created_at, updated_at 
+	err := h.db.QueryRowContext(r.Context(), `
+		SELECT id, firebase_uid, email, status, deletion_scheduled_at, created_at, updated_at
 		FROM users WHERE firebase_uid = $1
 	`, firebaseUID).Scan(
 		&user.ID,
 		&user.FirebaseUID,
 		&user.Email,
+		&user.Status,
+		&user.DeletionScheduledAt,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -111,7 +139,7 @@ func (h *AuthHandler) GetProfile(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		serverError(w, r, "Database error", err)
 		return
 	}
 
@@ -123,9 +151,9 @@ func (h *AuthHandler) GetProfile(w http.ResponseWriter, r *http.Request) {
 }
 
 // Helper function to get user by Firebase UID
-func (h *AuthHandler) GetUserByFirebaseUID(firebaseUID string) (*models.User, error) {
+func (h *AuthHandler) GetUserByFirebaseUID(ctx context.Context, firebaseUID string) (*models.User, error) {
 	var user models.User
-	err := h.db.QueryRow(`
+	err := h.db.QueryRowContext(ctx, `
 		SELECT id, firebase_uid, email, created_at, updated_at 
 		FROM users WHERE firebase_uid = $1
 	`, firebaseUID).Scan(
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"password-manager/breach"
+)
+
+// Padding bounds used when a client sends "Add-Padding: true", matching the
+// HIBP behaviour of returning 800-1000 lines so response size leaks nothing.
+const (
+	minPaddedLines = 800
+	maxPaddedLines = 1000
+)
+
+type BreachHandler struct {
+	store *breach.Store
+}
+
+// NewBreachHandler serves range lookups from store. A nil store means no
+// dataset has been imported and every lookup returns 503.
+func NewBreachHandler(store *breach.Store) *BreachHandler {
+	return &BreachHandler{store: store}
+}
+
+// GetRange is compatible with the Have I Been Pwned range API: it takes the
+// first five hex characters of a SHA-1 password hash and returns every known
+// suffix with that prefix as "SUFFIX:COUNT" lines. The full hash never leaves
+// the client, and the lookup is answered entirely from local data.
+func (h *BreachHandler) GetRange(w http.ResponseWriter, r *http.Request) {
+	if h.store == nil {
+		http.Error(w, "Breach data not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	body, err := h.store.Range(mux.Vars(r)["prefix"])
+	if errors.Is(err, breach.ErrInvalidPrefix) {
+		http.Error(w, "The hash prefix was not in a valid format", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Breach lookup failed", err)
+		return
+	}
+
+	if strings.EqualFold(r.Header.Get("Add-Padding"), "true") {
+		body = padRange(body)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Write(body)
+}
+
+// padRange appends random suffixes with a count of zero until the response has
+// a random length between minPaddedLines and maxPaddedLines. Clients ignore
+// zero-count lines.
+func padRange(body []byte) []byte {
+	lines := strings.Count(string(body), "\n")
+	target := minPaddedLines + rand.IntN(maxPaddedLines-minPaddedLines+1)
+
+	for ; lines < target; lines++ {
+		// A 35-character hex suffix: 16 + 16 + 3 digits.
+		body = fmt.Appendf(body, "%016X%016X%03X:0\r\n", rand.Uint64(), rand.Uint64(), rand.IntN(1<<12))
+	}
+	return body
+}
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"password-manager/audit"
+	"password-manager/middleware"
+	"password-manager/models"
+)
+
+// maxDeviceLogins caps the sign-in history returned for one device.
+const maxDeviceLogins = 50
+
+type DeviceHandler struct {
+	db   *sql.DB
+	auth *middleware.Authenticator
+}
+
+func NewDeviceHandler(db *sql.DB, auth *middleware.Authenticator) *DeviceHandler {
+	return &DeviceHandler{db: db, auth: auth}
+}
+
+// GetDevices lists every device that has used the account, most recently
+// seen first, including revoked ones.
+func (h *DeviceHandler) GetDevices(w http.ResponseWriter, r *http.Request) {
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := h.db.QueryContext(r.Context(), `
+		SELECT d.id, d.device_id, d.user_agent, d.last_ip, d.first_seen, d.last_seen, d.revoked_at
+		FROM devices d
+		JOIN users u ON u.id = d.user_id
+		WHERE u.firebase_uid = $1
+		ORDER BY d.last_seen DESC
+	`, firebaseUID)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	defer rows.Close()
+
+	devices := []models.Device{}
+	for rows.Next() {
+		var d models.Device
+		if err := rows.Scan(&d.ID, &d.DeviceID, &d.UserAgent, &d.LastIP, &d.FirstSeen, &d.LastSeen, &d.RevokedAt); err != nil {
+			serverError(w, r, "Database error", err)
+			return
+		}
+		devices = append(devices, d)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "Devices retrieved successfully",
+		Data:    devices,
+	})
+}
+
+// GetDeviceLogins returns the most recent sign-ins observed from a device.
+func (h *DeviceHandler) GetDeviceLogins(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := h.db.QueryContext(r.Context(), `
+		SELECT l.auth_time, l.ip, l.user_agent, l.created_at
+		FROM device_logins l
+		JOIN devices d ON d.id = l.device_id
+		JOIN users u ON u.id = d.user_id
+		WHERE d.id = $1 AND u.firebase_uid = $2
+		ORDER BY l.created_at DESC
+		LIMIT $3
+	`, deviceID, firebaseUID, maxDeviceLogins)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	defer rows.Close()
+
+	logins := []models.DeviceLogin{}
+	for rows.Next() {
+		var l models.DeviceLogin
+		if err := rows.Scan(&l.AuthTime, &l.IP, &l.UserAgent, &l.SeenAt); err != nil {
+			serverError(w, r, "Database error", err)
+			return
+		}
+		logins = append(logins, l)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "Device logins retrieved successfully",
+		Data:    logins,
+	})
+}
+
+// RevokeDevice blocks a device: from its next request on, the middleware
+// rejects it even if it still holds a valid token. The record is kept so the
+// block persists. A device that stops sending its ID cannot be told apart
+// from others, so every token issued before now is revoked as well, as in
+// RevokeAll: the user's other devices sign in again, the revoked one cannot.
+func (h *DeviceHandler) RevokeDevice(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Truncate to the second: token iat claims have one-second resolution.
+	result, err := h.db.ExecContext(r.Context(), `
+		WITH revoked AS (
+			UPDATE devices d
+			SET revoked_at = COALESCE(d.revoked_at, NOW())
+			FROM users u
+			WHERE d.id = $1 AND d.user_id = u.id AND u.firebase_uid = $2
+			RETURNING d.user_id
+		)
+		UPDATE users
+		SET tokens_valid_after = DATE_TRUNC('second', NOW()), updated_at = NOW()
+		WHERE id IN (SELECT user_id FROM revoked)
+	`, deviceID, firebaseUID)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	e := middleware.AuditEvent(r, audit.ActionDeviceRevoked)
+	e.TargetType = "device"
+	e.TargetID = deviceID.String()
+	recordEvent(h.db, r, e)
+
+	if err := h.auth.RevokeTokens(r.Context(), firebaseUID); err != nil {
+		// The device and the server-side cutoff are already revoked; only the
+		// provider's refresh tokens may still be usable to mint new tokens.
+		slog.ErrorContext(r.Context(), "provider token revocation failed", "err", err)
+		http.Error(w, "Failed to revoke provider sessions", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "Device revoked successfully",
+	})
+}
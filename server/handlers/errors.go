@@ -0,0 +1,13 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// serverError logs err, tagged with the request's ID, and responds 500 with
+// message. The underlying error never reaches the client.
+func serverError(w http.ResponseWriter, r *http.Request, message string, err error) {
+	slog.ErrorContext(r.Context(), message, "err", err, "method", r.Method, "path", r.URL.Path)
+	http.Error(w, message, http.StatusInternalServerError)
+}
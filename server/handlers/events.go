@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"password-manager/audit"
+	"password-manager/middleware"
+	"password-manager/models"
+)
+
+type EventHandler struct {
+	db *sql.DB
+}
+
+func NewEventHandler(db *sql.DB) *EventHandler {
+	return &EventHandler{db: db}
+}
+
+// GetEvents returns the caller's security history, newest first. It accepts
+// ?action= (comma-separated), ?since= and ?until= (RFC 3339), ?limit= and
+// ?offset=. Events caused by someone else, such as an admin, do not reveal
+// who they were or where they connected from.
+func (h *EventHandler) GetEvents(w http.ResponseWriter, r *http.Request) {
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	filter, ok := parseEventFilter(w, r.URL.Query())
+	if !ok {
+		return
+	}
+	filter.Limit, filter.Offset, ok = parsePage(w, r.URL.Query())
+	if !ok {
+		return
+	}
+
+	var userID uuid.UUID
+	err := h.db.QueryRowContext(r.Context(), `SELECT id FROM users WHERE firebase_uid = $1`, firebaseUID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	filter.UserID = &userID
+
+	events := []models.AuditEvent{}
+	err = audit.List(r.Context(), h.db, filter, func(e models.AuditEvent) error {
+		if e.ActorUID != firebaseUID {
+			e.ActorUID, e.IP, e.UserAgent = "", "", ""
+		}
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "Events retrieved successfully",
+		Data:    events,
+	})
+}
+
+// recordEvent writes e after the change it describes has been made. A
+// failure is only logged: the change cannot be taken back at this point.
+func recordEvent(db *sql.DB, r *http.Request, e audit.Event) {
+	if err := audit.Record(r.Context(), db, e); err != nil {
+		slog.ErrorContext(r.Context(), "failed to record audit event", "action", e.Action, "err", err)
+	}
+}
+
+// parseEventFilter reads the action, since and until filters shared by the
+// event endpoints, writing a 400 if one is malformed.
+func parseEventFilter(w http.ResponseWriter, query url.Values) (audit.Filter, bool) {
+	var (
+		filter audit.Filter
+		err    error
+	)
+	if actions := query.Get("action"); actions != "" {
+		filter.Actions = strings.Split(actions, ",")
+	}
+	if since := query.Get("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			http.Error(w, "Invalid since: use RFC 3339", http.StatusBadRequest)
+			return filter, false
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			http.Error(w, "Invalid until: use RFC 3339", http.StatusBadRequest)
+			return filter, false
+		}
+	}
+	return filter, true
+}
+
+// parsePage reads ?limit= and ?offset=, writing a 400 if either is invalid.
+func parsePage(w http.ResponseWriter, query url.Values) (limit, offset int, ok bool) {
+	limit, err := queryInt(query.Get("limit"), defaultPageSize)
+	if err != nil || limit < 1 || limit > maxPageSize {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	offset, err = queryInt(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return limit, offset, true
+}
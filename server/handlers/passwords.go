@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"net/http"
@@ -10,17 +11,20 @@ import (
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 
+	"password-manager/audit"
+	"password-manager/metrics"
 	"password-manager/middleware"
 	"password-manager/models"
 	"password-manager/utils"
 )
 
 type PasswordHandler struct {
-	db *sql.DB
+	db    *sql.DB
+	quota Quota
 }
 
-func NewPasswordHandler(db *sql.DB) *PasswordHandler {
-	return &PasswordHandler{db: db}
+func NewPasswordHandler(db *sql.DB, quota Quota) *PasswordHandler {
+	return &PasswordHandler{db: db, quota: quota}
 }
 
 // GetPasswords returns all password entries for the authenticated user. Every
@@ -33,21 +37,21 @@ func (h *PasswordHandler) GetPasswords(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID, err := h.getUserID(firebaseUID)
+	userID, err := h.getUserID(r.Context(), firebaseUID)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	rows, err := h.db.Query(`
-		SELECT id, user_id, service_name, encrypted_password, encrypted_username, encrypted_url, encrypted_notes, created_at, updated_at
+	rows, err := h.db.QueryContext(r.Context(), `
+		SELECT `+entryColumns+`
 		FROM password_entries
 		WHERE user_id = $1
 		ORDER BY created_at ASC
 	`, userID)
 
 	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		serverError(w, r, "Database error", err)
 		return
 	}
 	defer rows.Close()
@@ -55,17 +59,7 @@ func (h *PasswordHandler) GetPasswords(w http.ResponseWriter, r *http.Request) {
 	passwords := []models.PasswordEntry{}
 	for rows.Next() {
 		var entry models.PasswordEntry
-		if err := rows.Scan(
-			&entry.ID,
-			&entry.UserID,
-			&entry.ServiceName,
-			&entry.EncryptedPassword,
-			&entry.EncryptedUsername,
-			&entry.EncryptedURL,
-			&entry.EncryptedNotes,
-			&entry.CreatedAt,
-			&entry.UpdatedAt,
-		); err != nil {
+		if err := rows.Scan(entryFields(&entry)...); err != nil {
 			continue
 		}
 		passwords = append(passwords, entry)
@@ -93,35 +87,25 @@ func (h *PasswordHandler) GetPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID, err := h.getUserID(firebaseUID)
+	userID, err := h.getUserID(r.Context(), firebaseUID)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
 	var entry models.PasswordEntry
-	err = h.db.QueryRow(`
-		SELECT id, user_id, service_name, encrypted_password, encrypted_username, encrypted_url, encrypted_notes, created_at, updated_at
+	err = h.db.QueryRowContext(r.Context(), `
+		SELECT `+entryColumns+`
 		FROM password_entries
 		WHERE id = $1 AND user_id = $2
-	`, passwordID, userID).Scan(
-		&entry.ID,
-		&entry.UserID,
-		&entry.ServiceName,
-		&entry.EncryptedPassword,
-		&entry.EncryptedUsername,
-		&entry.EncryptedURL,
-		&entry.EncryptedNotes,
-		&entry.CreatedAt,
-		&entry.UpdatedAt,
-	)
+	`, passwordID, userID).Scan(entryFields(&entry)...)
 
 	if err == sql.ErrNoRows {
 		http.Error(w, "Password not found", http.StatusNotFound)
 		return
 	}
 	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		serverError(w, r, "Database error", err)
 		return
 	}
 
@@ -141,7 +125,7 @@ func (h *PasswordHandler) CreatePassword(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	userID, err := h.getUserID(firebaseUID)
+	userID, err := h.getUserID(r.Context(), firebaseUID)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
@@ -157,28 +141,42 @@ func (h *PasswordHandler) CreatePassword(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := lockUsage(r.Context(), tx, userID)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
 	var entry models.PasswordEntry
-	err = h.db.QueryRow(`
-		INSERT INTO password_entries (user_id, service_name, encrypted_password, encrypted_username, encrypted_url, encrypted_notes)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		RETURNING id, user_id, service_name, encrypted_password, encrypted_username, encrypted_url, encrypted_notes, created_at, updated_at
-	`, userID, req.ServiceName, req.EncryptedPassword, req.EncryptedUsername, req.EncryptedURL, req.EncryptedNotes).Scan(
-		&entry.ID,
-		&entry.UserID,
-		&entry.ServiceName,
-		&entry.EncryptedPassword,
-		&entry.EncryptedUsername,
-		&entry.EncryptedURL,
-		&entry.EncryptedNotes,
-		&entry.CreatedAt,
-		&entry.UpdatedAt,
-	)
+	err = tx.QueryRowContext(r.Context(), `
+		INSERT INTO password_entries (user_id, service_name, encrypted_password, encrypted_username, encrypted_url, encrypted_notes, password_fingerprint, strength_bucket)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING `+entryColumns,
+		userID, req.ServiceName, req.EncryptedPassword, req.EncryptedUsername, req.EncryptedURL, req.EncryptedNotes,
+		req.PasswordFingerprint, req.StrengthBucket,
+	).Scan(entryFields(&entry)...)
 
 	if err != nil {
-		http.Error(w, "Failed to create password entry", http.StatusInternalServerError)
+		serverError(w, r, "Failed to create password entry", err)
+		return
+	}
+	if err := audit.Record(r.Context(), tx, entryEvent(r, audit.ActionEntryCreated, entry.ID)); err != nil {
+		serverError(w, r, "Database error", err)
 		return
 	}
 
+	if !h.commitWithinQuota(w, r, tx, userID, before) {
+		return
+	}
+	metrics.EntriesCreated.Inc()
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(models.SuccessResponse{
@@ -202,7 +200,7 @@ func (h *PasswordHandler) UpdatePassword(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	userID, err := h.getUserID(firebaseUID)
+	userID, err := h.getUserID(r.Context(), firebaseUID)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
@@ -220,7 +218,7 @@ func (h *PasswordHandler) UpdatePassword(w http.ResponseWriter, r *http.Request)
 
 	// Check the entry exists and belongs to the user
 	var exists bool
-	err = h.db.QueryRow(`
+	err = h.db.QueryRowContext(r.Context(), `
 		SELECT EXISTS(SELECT 1 FROM password_entries WHERE id = $1 AND user_id = $2)
 	`, passwordID, userID).Scan(&exists)
 	if err != nil || !exists {
@@ -239,9 +237,28 @@ func (h *PasswordHandler) UpdatePassword(w http.ResponseWriter, r *http.Request)
 		argCount++
 	}
 	if req.EncryptedPassword != "" {
-		updateFields = append(updateFields, "encrypted_password = $"+strconv.Itoa(argCount))
+		updateFields = append(updateFields, "encrypted_password = $"+strconv.Itoa(argCount), "password_updated_at = NOW()")
 		args = append(args, req.EncryptedPassword)
 		argCount++
+
+		// A new password invalidates the old health metadata unless the
+		// client sent fresh values in the same request.
+		if req.PasswordFingerprint == nil {
+			updateFields = append(updateFields, "password_fingerprint = NULL")
+		}
+		if req.StrengthBucket == nil {
+			updateFields = append(updateFields, "strength_bucket = NULL")
+		}
+	}
+	if req.PasswordFingerprint != nil {
+		updateFields = append(updateFields, "password_fingerprint = $"+strconv.Itoa(argCount))
+		args = append(args, req.PasswordFingerprint)
+		argCount++
+	}
+	if req.StrengthBucket != nil {
+		updateFields = append(updateFields, "strength_bucket = $"+strconv.Itoa(argCount))
+		args = append(args, req.StrengthBucket)
+		argCount++
 	}
 	if req.EncryptedUsername != nil {
 		updateFields = append(updateFields, "encrypted_username = $"+strconv.Itoa(argCount))
@@ -271,24 +288,36 @@ func (h *PasswordHandler) UpdatePassword(w http.ResponseWriter, r *http.Request)
 		UPDATE password_entries
 		SET ` + strings.Join(updateFields, ", ") + `
 		WHERE id = $` + strconv.Itoa(argCount) + ` AND user_id = $` + strconv.Itoa(argCount+1) + `
-		RETURNING id, user_id, service_name, encrypted_password, encrypted_username, encrypted_url, encrypted_notes, created_at, updated_at
-	`
+		RETURNING ` + entryColumns
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := lockUsage(r.Context(), tx, userID)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
 
 	var entry models.PasswordEntry
-	err = h.db.QueryRow(query, args...).Scan(
-		&entry.ID,
-		&entry.UserID,
-		&entry.ServiceName,
-		&entry.EncryptedPassword,
-		&entry.EncryptedUsername,
-		&entry.EncryptedURL,
-		&entry.EncryptedNotes,
-		&entry.CreatedAt,
-		&entry.UpdatedAt,
-	)
+	err = tx.QueryRowContext(r.Context(), query, args...).Scan(entryFields(&entry)...)
 
 	if err != nil {
-		http.Error(w, "Failed to update password entry", http.StatusInternalServerError)
+		serverError(w, r, "Failed to update password entry", err)
+		return
+	}
+	e := entryEvent(r, audit.ActionEntryUpdated, entry.ID)
+	e.Details = map[string]interface{}{"password_changed": req.EncryptedPassword != ""}
+	if err := audit.Record(r.Context(), tx, e); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	if !h.commitWithinQuota(w, r, tx, userID, before) {
 		return
 	}
 
@@ -314,19 +343,26 @@ func (h *PasswordHandler) DeletePassword(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	userID, err := h.getUserID(firebaseUID)
+	userID, err := h.getUserID(r.Context(), firebaseUID)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	result, err := h.db.Exec(`
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(r.Context(), `
 		DELETE FROM password_entries
 		WHERE id = $1 AND user_id = $2
 	`, passwordID, userID)
 
 	if err != nil {
-		http.Error(w, "Failed to delete password entry", http.StatusInternalServerError)
+		serverError(w, r, "Failed to delete password entry", err)
 		return
 	}
 
@@ -335,6 +371,15 @@ func (h *PasswordHandler) DeletePassword(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Password not found", http.StatusNotFound)
 		return
 	}
+	if err := audit.Record(r.Context(), tx, entryEvent(r, audit.ActionEntryDeleted, passwordID)); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	metrics.EntriesDeleted.Inc()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(models.SuccessResponse{
@@ -342,10 +387,62 @@ func (h *PasswordHandler) DeletePassword(w http.ResponseWriter, r *http.Request)
 	})
 }
 
+// commitWithinQuota re-measures usage after a write made in tx and commits it
+// only if the account is still within its quota. On failure it writes the
+// error response and returns false; the caller's deferred Rollback undoes the
+// write.
+func (h *PasswordHandler) commitWithinQuota(w http.ResponseWriter, r *http.Request, tx *sql.Tx, userID uuid.UUID, before usage) bool {
+	after, err := queryUsage(r.Context(), tx, userID)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return false
+	}
+	if qerr := h.quota.check(before, after); qerr != nil {
+		writeQuotaError(w, qerr)
+		return false
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(w, r, "Database error", err)
+		return false
+	}
+	return true
+}
+
+// entryEvent starts an audit event for action on entry id. It names the
+// entry only by ID, never by its label.
+func entryEvent(r *http.Request, action string, id uuid.UUID) audit.Event {
+	e := middleware.AuditEvent(r, action)
+	e.TargetType = "entry"
+	e.TargetID = id.String()
+	return e
+}
+
+// entryColumns is the column list matching entryFields, in order.
+const entryColumns = `id, user_id, service_name, encrypted_password, encrypted_username, encrypted_url, encrypted_notes,
+		password_fingerprint, strength_bucket, password_updated_at, created_at, updated_at`
+
+// entryFields returns scan destinations for a row selected with entryColumns.
+func entryFields(entry *models.PasswordEntry) []interface{} {
+	return []interface{}{
+		&entry.ID,
+		&entry.UserID,
+		&entry.ServiceName,
+		&entry.EncryptedPassword,
+		&entry.EncryptedUsername,
+		&entry.EncryptedURL,
+		&entry.EncryptedNotes,
+		&entry.PasswordFingerprint,
+		&entry.StrengthBucket,
+		&entry.PasswordUpdatedAt,
+		&entry.CreatedAt,
+		&entry.UpdatedAt,
+	}
+}
+
 // Helper function to get user ID from Firebase UID
-func (h *PasswordHandler) getUserID(firebaseUID string) (uuid.UUID, error) {
+func (h *PasswordHandler) getUserID(ctx context.Context, firebaseUID string) (uuid.UUID, error) {
 	var userID uuid.UUID
-	err := h.db.QueryRow(`
+	err := h.db.QueryRowContext(ctx, `
 		SELECT id FROM users WHERE firebase_uid = $1
 	`, firebaseUID).Scan(&userID)
 	return userID, err
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+
+	"password-manager/middleware"
+	"password-manager/models"
+)
+
+// Quota caps how much a single account may store. Zero means unlimited.
+type Quota struct {
+	MaxEntries int
+	MaxBytes   int64
+}
+
+// usage is an account's current entry count and total ciphertext size.
+type usage struct {
+	entries int
+	bytes   int64
+}
+
+// quotaError is returned when a write would take an account past a limit.
+type quotaError struct {
+	status  int
+	code    string
+	message string
+}
+
+var (
+	errEntryLimit = &quotaError{http.StatusConflict, "entry_limit_reached", "Entry limit reached for this account"}
+	errByteLimit  = &quotaError{http.StatusRequestEntityTooLarge, "storage_limit_reached", "Storage limit reached for this account"}
+)
+
+// lockUsage locks the user's row for the rest of tx, serialising concurrent
+// writes by the same account, and returns its current usage.
+func lockUsage(ctx context.Context, tx *sql.Tx, userID uuid.UUID) (usage, error) {
+	if _, err := tx.ExecContext(ctx, `SELECT 1 FROM users WHERE id = $1 FOR UPDATE`, userID); err != nil {
+		return usage{}, err
+	}
+	return queryUsage(ctx, tx, userID)
+}
+
+// entryBytes is the ciphertext size of a password_entries row. The plaintext
+// service_name label and health metadata are not counted.
+const entryBytes = `
+	OCTET_LENGTH(encrypted_password)
+	+ COALESCE(OCTET_LENGTH(encrypted_username), 0)
+	+ COALESCE(OCTET_LENGTH(encrypted_url), 0)
+	+ COALESCE(OCTET_LENGTH(encrypted_notes), 0)`
+
+// queryUsage sums the ciphertext stored by a user.
+func queryUsage(ctx context.Context, q interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}, userID uuid.UUID) (usage, error) {
+	var u usage
+	err := q.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(`+entryBytes+`), 0)
+		FROM password_entries WHERE user_id = $1
+	`, userID).Scan(&u.entries, &u.bytes)
+	return u, err
+}
+
+// check compares usage before and after a write. A write that leaves an
+// account over a limit is rejected only if it grew usage, so an account that
+// is already over a lowered limit can still edit or shrink its entries.
+func (q Quota) check(before, after usage) *quotaError {
+	if q.MaxEntries > 0 && after.entries > q.MaxEntries && after.entries > before.entries {
+		return errEntryLimit
+	}
+	if q.MaxBytes > 0 && after.bytes > q.MaxBytes && after.bytes > before.bytes {
+		return errByteLimit
+	}
+	return nil
+}
+
+// writeQuotaError reports a quota violation with its stable error code.
+func writeQuotaError(w http.ResponseWriter, err *quotaError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(err.status)
+	json.NewEncoder(w).Encode(models.ErrorResponse{
+		Error: err.message,
+		Code:  err.code,
+	})
+}
+
+// GetUsage reports the user's entry count and ciphertext bytes against the
+// configured limits.
+func (h *PasswordHandler) GetUsage(w http.ResponseWriter, r *http.Request) {
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := h.getUserID(r.Context(), firebaseUID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	u, err := queryUsage(r.Context(), h.db, userID)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	resp := models.Usage{Entries: u.entries, Bytes: u.bytes}
+	if h.quota.MaxEntries > 0 {
+		resp.MaxEntries = &h.quota.MaxEntries
+	}
+	if h.quota.MaxBytes > 0 {
+		resp.MaxBytes = &h.quota.MaxBytes
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "Usage retrieved successfully",
+		Data:    resp,
+	})
+}
@@ -0,0 +1,541 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"password-manager/audit"
+	"password-manager/auth"
+	"password-manager/metrics"
+	"password-manager/middleware"
+	"password-manager/models"
+	"password-manager/utils"
+)
+
+const (
+	// totpIssuer labels the account in authenticator apps.
+	totpIssuer = "Keyzy"
+	// maxSecondFactorFailures wrong codes in a row lock second-factor checks
+	// for secondFactorLockout. A 6-digit code with a ±1 step window cannot
+	// then be brute-forced within the rate limit.
+	maxSecondFactorFailures = 5
+	secondFactorLockout     = 15 * time.Minute
+)
+
+// SecondFactorHandler manages TOTP, WebAuthn credentials and recovery codes,
+// and exchanges a successful second-factor check for a step-up token.
+type SecondFactorHandler struct {
+	db       *sql.DB
+	webauthn *webauthn.WebAuthn // nil when WebAuthn is not configured
+}
+
+func NewSecondFactorHandler(db *sql.DB, wa *webauthn.WebAuthn) *SecondFactorHandler {
+	return &SecondFactorHandler{db: db, webauthn: wa}
+}
+
+// GetStatus reports which second factors the user has enrolled.
+func (h *SecondFactorHandler) GetStatus(w http.ResponseWriter, r *http.Request) {
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	status := models.SecondFactorStatus{WebAuthnAvailable: h.webauthn != nil}
+	err := h.db.QueryRowContext(r.Context(), `
+		SELECT u.totp_enabled_at IS NOT NULL,
+			(SELECT COUNT(*) FROM webauthn_credentials c WHERE c.user_id = u.id),
+			(SELECT COUNT(*) FROM recovery_codes rc WHERE rc.user_id = u.id AND rc.used_at IS NULL)
+		FROM users u WHERE u.firebase_uid = $1
+	`, firebaseUID).Scan(&status.TOTPEnabled, &status.WebAuthnCredentials, &status.RecoveryCodesRemaining)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	status.Enabled = status.TOTPEnabled || status.WebAuthnCredentials > 0
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "Second factor status retrieved successfully",
+		Data:    status,
+	})
+}
+
+// EnrollTOTP generates a new TOTP secret for the user. It is not used for
+// verification until ConfirmTOTP sees a valid code from it, so an abandoned
+// enrolment cannot lock the user out.
+func (h *SecondFactorHandler) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		serverError(w, r, "Failed to generate TOTP secret", err)
+		return
+	}
+
+	var email sql.NullString
+	err = h.db.QueryRowContext(r.Context(), `
+		UPDATE users
+		SET totp_secret = $1, totp_last_step = NULL, updated_at = NOW()
+		WHERE firebase_uid = $2 AND totp_enabled_at IS NULL
+		RETURNING email
+	`, secret, firebaseUID).Scan(&email)
+	if err == sql.ErrNoRows {
+		// Either the user doesn't exist or TOTP is already enabled.
+		http.Error(w, "TOTP is already enabled", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	account := email.String
+	if account == "" {
+		account = firebaseUID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "Scan the secret with an authenticator app, then confirm a code",
+		Data: models.TOTPEnrollment{
+			Secret: secret,
+			URI:    auth.TOTPURI(secret, totpIssuer, account),
+		},
+	})
+}
+
+// ConfirmTOTP enables a pending TOTP secret once the user proves their app
+// generates valid codes for it. If this is the account's first second factor,
+// the response carries a fresh set of recovery codes and the account's access
+// tokens are revoked.
+func (h *SecondFactorHandler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req models.ConfirmTOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := utils.Validate(&req); err != nil {
+		http.Error(w, "Invalid input: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var (
+		userID uuid.UUID
+		secret sql.NullString
+	)
+	err = tx.QueryRowContext(r.Context(), `
+		SELECT id, totp_secret FROM users
+		WHERE firebase_uid = $1 AND totp_enabled_at IS NULL
+		FOR UPDATE
+	`, firebaseUID).Scan(&userID, &secret)
+	if err == sql.ErrNoRows || (err == nil && !secret.Valid) {
+		http.Error(w, "No TOTP enrolment in progress", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(secret.String, req.Code, time.Now())
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	revoked, err := revokeAccessTokensOnFirstFactor(r.Context(), tx, userID)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if _, err := tx.ExecContext(r.Context(), `
+		UPDATE users
+		SET totp_enabled_at = NOW(), totp_last_step = $2, updated_at = NOW()
+		WHERE id = $1
+	`, userID, step); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	codes, err := ensureRecoveryCodes(r.Context(), tx, userID)
+	if err != nil {
+		serverError(w, r, "Failed to generate recovery codes", err)
+		return
+	}
+	e := middleware.AuditEvent(r, audit.ActionTOTPEnabled)
+	if revoked > 0 {
+		e.Details = map[string]interface{}{"access_tokens_revoked": revoked}
+	}
+	if err := audit.Record(r.Context(), tx, e); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	resp := models.SuccessResponse{Message: "TOTP enabled successfully"}
+	if codes != nil {
+		resp.Message = "TOTP enabled. Store these recovery codes safely; they will not be shown again."
+		resp.Data = models.RecoveryCodes{Codes: codes}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// DisableTOTP removes the user's TOTP secret. Recovery codes are dropped too
+// if no other second factor remains.
+func (h *SecondFactorHandler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var userID uuid.UUID
+	err = tx.QueryRowContext(r.Context(), `
+		UPDATE users
+		SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = NULL, updated_at = NOW()
+		WHERE firebase_uid = $1 AND totp_secret IS NOT NULL
+		RETURNING id
+	`, firebaseUID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "TOTP is not enabled", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if err := dropOrphanedRecoveryCodes(r.Context(), tx, userID); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if err := audit.Record(r.Context(), tx, middleware.AuditEvent(r, audit.ActionTOTPDisabled)); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "TOTP disabled successfully",
+	})
+}
+
+// RegenerateRecoveryCodes replaces all of the user's recovery codes, used or
+// not, with a new set.
+func (h *SecondFactorHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var (
+		userID   uuid.UUID
+		enrolled bool
+	)
+	err = tx.QueryRowContext(r.Context(), `
+		SELECT u.id, u.totp_enabled_at IS NOT NULL
+			OR EXISTS (SELECT 1 FROM webauthn_credentials c WHERE c.user_id = u.id)
+		FROM users u WHERE u.firebase_uid = $1
+		FOR UPDATE
+	`, firebaseUID).Scan(&userID, &enrolled)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if !enrolled {
+		http.Error(w, "Enable a second factor first", http.StatusConflict)
+		return
+	}
+
+	if _, err := tx.ExecContext(r.Context(), `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	codes, err := ensureRecoveryCodes(r.Context(), tx, userID)
+	if err != nil {
+		serverError(w, r, "Failed to generate recovery codes", err)
+		return
+	}
+	if err := audit.Record(r.Context(), tx, middleware.AuditEvent(r, audit.ActionRecoveryCodesRegenerated)); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "Store these recovery codes safely; they will not be shown again.",
+		Data:    models.RecoveryCodes{Codes: codes},
+	})
+}
+
+// Verify checks a TOTP code or an unused recovery code and returns a step-up
+// token. Repeated failures lock the check for a while.
+func (h *SecondFactorHandler) Verify(w http.ResponseWriter, r *http.Request) {
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req models.VerifySecondFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := utils.Validate(&req); err != nil {
+		http.Error(w, "Invalid input: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var (
+		userID   uuid.UUID
+		secret   sql.NullString
+		lastStep sql.NullInt64
+		locked   bool
+	)
+	err := h.db.QueryRowContext(r.Context(), `
+		SELECT id, CASE WHEN totp_enabled_at IS NOT NULL THEN totp_secret END, totp_last_step,
+			COALESCE(mfa_locked_until > NOW(), FALSE)
+		FROM users WHERE firebase_uid = $1
+	`, firebaseUID).Scan(&userID, &secret, &lastStep, &locked)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if locked {
+		http.Error(w, "Too many failed attempts; try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	ok, err := h.checkCode(r.Context(), userID, secret, lastStep, req.Code)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if !ok {
+		if err := h.recordFailure(r.Context(), userID); err != nil {
+			serverError(w, r, "Database error", err)
+			return
+		}
+		metrics.AuthFailures.WithLabelValues("second_factor_code").Inc()
+		e := middleware.AuditEvent(r, audit.ActionSecondFactorFailed)
+		e.Details = map[string]interface{}{"method": "code"}
+		recordEvent(h.db, r, e)
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	h.issueStepUp(w, r, userID, "code")
+}
+
+// checkCode accepts a TOTP code from a step later than the last one used, or
+// consumes an unused recovery code.
+func (h *SecondFactorHandler) checkCode(ctx context.Context, userID uuid.UUID, secret sql.NullString, lastStep sql.NullInt64, code string) (bool, error) {
+	if secret.Valid {
+		if step, ok := auth.ValidateTOTP(secret.String, code, time.Now()); ok && (!lastStep.Valid || step > lastStep.Int64) {
+			// The conditional update stops two concurrent requests with the
+			// same code from both succeeding.
+			result, err := h.db.ExecContext(ctx, `
+				UPDATE users SET totp_last_step = $2
+				WHERE id = $1 AND (totp_last_step IS NULL OR totp_last_step < $2)
+			`, userID, step)
+			if err != nil {
+				return false, err
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return false, err
+			}
+			if n == 1 {
+				return true, nil
+			}
+		}
+	}
+
+	result, err := h.db.ExecContext(ctx, `
+		UPDATE recovery_codes SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`, userID, auth.HashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// recordFailure counts a wrong code and starts a lockout once there have been
+// maxSecondFactorFailures in a row. The counter restarts after each lockout.
+func (h *SecondFactorHandler) recordFailure(ctx context.Context, userID uuid.UUID) error {
+	_, err := h.db.ExecContext(ctx, `
+		UPDATE users SET
+			mfa_failed_attempts = CASE WHEN mfa_failed_attempts + 1 >= $2 THEN 0 ELSE mfa_failed_attempts + 1 END,
+			mfa_locked_until = CASE WHEN mfa_failed_attempts + 1 >= $2 THEN NOW() + $3 * INTERVAL '1 second' ELSE mfa_locked_until END
+		WHERE id = $1
+	`, userID, maxSecondFactorFailures, int(secondFactorLockout.Seconds()))
+	return err
+}
+
+// issueStepUp clears the failure counter, audits the successful check made
+// with method and responds with a new step-up token for userID.
+func (h *SecondFactorHandler) issueStepUp(w http.ResponseWriter, r *http.Request, userID uuid.UUID, method string) {
+	token, hash, err := auth.NewStepUpToken()
+	if err != nil {
+		serverError(w, r, "Failed to create step-up token", err)
+		return
+	}
+	expiresAt := time.Now().Add(auth.StepUpTTL)
+
+	if _, err := h.db.ExecContext(r.Context(), `
+		UPDATE users SET mfa_failed_attempts = 0, mfa_locked_until = NULL WHERE id = $1
+	`, userID); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	// Expired tokens are useless; clear them out while we're here.
+	if _, err := h.db.ExecContext(r.Context(), `
+		DELETE FROM step_up_tokens WHERE user_id = $1 AND expires_at <= NOW()
+	`, userID); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if _, err := h.db.ExecContext(r.Context(), `
+		INSERT INTO step_up_tokens (token_hash, user_id, expires_at) VALUES ($1, $2, $3)
+	`, hash, userID, expiresAt); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	e := middleware.AuditEvent(r, audit.ActionSecondFactorVerified)
+	e.Details = map[string]interface{}{"method": method}
+	recordEvent(h.db, r, e)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "Second factor verified",
+		Data:    models.StepUp{Token: token, ExpiresAt: expiresAt},
+	})
+}
+
+// ensureRecoveryCodes generates recovery codes for userID unless it still has
+// unused ones, in which case it returns nil.
+func ensureRecoveryCodes(ctx context.Context, tx *sql.Tx, userID uuid.UUID) ([]string, error) {
+	var remaining int
+	if err := tx.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL
+	`, userID).Scan(&remaining); err != nil {
+		return nil, err
+	}
+	if remaining > 0 {
+		return nil, nil
+	}
+
+	codes, hashes, err := auth.NewRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO recovery_codes (user_id, code_hash)
+		SELECT $1::uuid, UNNEST($2::bytea[])
+	`, userID, pq.Array(hashes)); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// revokeAccessTokensOnFirstFactor deletes userID's access tokens if it has no
+// second factor yet, and is called just before one is enrolled. Access tokens
+// skip step-up, so tokens created while the account had no second factor must
+// not outlive its first one. It returns how many tokens were deleted.
+func revokeAccessTokensOnFirstFactor(ctx context.Context, tx *sql.Tx, userID uuid.UUID) (int64, error) {
+	var enrolled bool
+	if err := tx.QueryRowContext(ctx, `
+		SELECT totp_enabled_at IS NOT NULL
+			OR EXISTS (SELECT 1 FROM webauthn_credentials c WHERE c.user_id = u.id)
+		FROM users u WHERE u.id = $1
+		FOR UPDATE
+	`, userID).Scan(&enrolled); err != nil || enrolled {
+		return 0, err
+	}
+	result, err := tx.ExecContext(ctx, `DELETE FROM access_tokens WHERE user_id = $1`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// dropOrphanedRecoveryCodes deletes userID's recovery codes once it has no
+// second factor left for them to stand in for.
+func dropOrphanedRecoveryCodes(ctx context.Context, tx *sql.Tx, userID uuid.UUID) error {
+	_, err := tx.ExecContext(ctx, `
+		DELETE FROM recovery_codes rc
+		USING users u
+		WHERE rc.user_id = u.id AND u.id = $1
+		  AND u.totp_enabled_at IS NULL
+		  AND NOT EXISTS (SELECT 1 FROM webauthn_credentials c WHERE c.user_id = u.id)
+	`, userID)
+	return err
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"password-manager/audit"
+	"password-manager/middleware"
+	"password-manager/models"
+)
+
+type SessionHandler struct {
+	db   *sql.DB
+	auth *middleware.Authenticator
+}
+
+func NewSessionHandler(db *sql.DB, auth *middleware.Authenticator) *SessionHandler {
+	return &SessionHandler{db: db, auth: auth}
+}
+
+// RevokeAll signs the user out everywhere: every token issued before now is
+// rejected from the next request on, whichever identity provider issued it.
+// The provider's refresh tokens are revoked too where it supports that, so
+// stolen sessions cannot mint fresh tokens either.
+func (h *SessionHandler) RevokeAll(w http.ResponseWriter, r *http.Request) {
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Truncate to the second: token iat claims have one-second resolution.
+	result, err := h.db.ExecContext(r.Context(), `
+		UPDATE users
+		SET tokens_valid_after = DATE_TRUNC('second', NOW()), updated_at = NOW()
+		WHERE firebase_uid = $1
+	`, firebaseUID)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if rowsAffected, err := result.RowsAffected(); err != nil || rowsAffected == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	recordEvent(h.db, r, middleware.AuditEvent(r, audit.ActionSessionsRevoked))
+
+	if err := h.auth.RevokeTokens(r.Context(), firebaseUID); err != nil {
+		// The server-side cutoff is already in place; only the provider's
+		// refresh tokens may still be usable to mint new tokens.
+		slog.ErrorContext(r.Context(), "provider token revocation failed", "err", err)
+		http.Error(w, "Failed to revoke provider sessions", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "All sessions revoked",
+	})
+}
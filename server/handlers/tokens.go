@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+
+	"password-manager/audit"
+	"password-manager/auth"
+	"password-manager/middleware"
+	"password-manager/models"
+	"password-manager/utils"
+)
+
+// maxAccessTokensPerUser keeps token lists manageable and bounds the damage of
+// a script that creates tokens in a loop.
+const maxAccessTokensPerUser = 50
+
+type AccessTokenHandler struct {
+	db *sql.DB
+}
+
+func NewAccessTokenHandler(db *sql.DB) *AccessTokenHandler {
+	return &AccessTokenHandler{db: db}
+}
+
+// GetTokens lists the user's personal access tokens. Secrets are never
+// returned; only the non-secret hint is.
+func (h *AccessTokenHandler) GetTokens(w http.ResponseWriter, r *http.Request) {
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := h.db.QueryContext(r.Context(), `
+		SELECT t.id, t.name, t.token_hint, t.scopes, t.expires_at, t.last_used_at, t.created_at
+		FROM access_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE u.firebase_uid = $1
+		ORDER BY t.created_at DESC
+	`, firebaseUID)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	defer rows.Close()
+
+	tokens := []models.AccessToken{}
+	for rows.Next() {
+		var t models.AccessToken
+		if err := rows.Scan(&t.ID, &t.Name, &t.Hint, pq.Array(&t.Scopes), &t.ExpiresAt, &t.LastUsedAt, &t.CreatedAt); err != nil {
+			serverError(w, r, "Database error", err)
+			return
+		}
+		tokens = append(tokens, t)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "Access tokens retrieved successfully",
+		Data:    tokens,
+	})
+}
+
+// CreateToken mints a personal access token with the requested scopes and
+// optional expiry. The plaintext token is in this response only.
+func (h *AccessTokenHandler) CreateToken(w http.ResponseWriter, r *http.Request) {
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req models.CreateAccessTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := utils.Validate(&req); err != nil {
+		http.Error(w, "Invalid input: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, hash, err := auth.NewAccessToken()
+	if err != nil {
+		serverError(w, r, "Failed to create access token", err)
+		return
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresInDays != nil {
+		t := time.Now().AddDate(0, 0, *req.ExpiresInDays)
+		expiresAt = &t
+	}
+
+	// The count check and insert are one statement, so concurrent requests
+	// cannot push a user past the limit.
+	created := models.CreatedAccessToken{Token: token}
+	err = h.db.QueryRowContext(r.Context(), `
+		INSERT INTO access_tokens (user_id, name, token_hash, token_hint, scopes, expires_at)
+		SELECT u.id, $2::text, $3::bytea, $4::text, $5::text[], $6::timestamptz
+		FROM users u
+		WHERE u.firebase_uid = $1
+		  AND (SELECT COUNT(*) FROM access_tokens t WHERE t.user_id = u.id) < $7
+		RETURNING id, name, token_hint, scopes, expires_at, created_at
+	`, firebaseUID, req.Name, hash, auth.AccessTokenHint(token), pq.Array(req.Scopes), expiresAt, maxAccessTokensPerUser).Scan(
+		&created.ID,
+		&created.Name,
+		&created.Hint,
+		pq.Array(&created.Scopes),
+		&created.ExpiresAt,
+		&created.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found or access token limit reached", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Failed to create access token", err)
+		return
+	}
+	e := middleware.AuditEvent(r, audit.ActionTokenCreated)
+	e.TargetType = "access_token"
+	e.TargetID = created.ID.String()
+	e.Details = map[string]interface{}{"name": created.Name, "scopes": created.Scopes}
+	recordEvent(h.db, r, e)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "Access token created. Copy it now; it will not be shown again.",
+		Data:    created,
+	})
+}
+
+// DeleteToken revokes a personal access token immediately.
+func (h *AccessTokenHandler) DeleteToken(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	result, err := h.db.ExecContext(r.Context(), `
+		DELETE FROM access_tokens t
+		USING users u
+		WHERE t.id = $1 AND t.user_id = u.id AND u.firebase_uid = $2
+	`, tokenID, firebaseUID)
+	if err != nil {
+		serverError(w, r, "Failed to revoke access token", err)
+		return
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		http.Error(w, "Access token not found", http.StatusNotFound)
+		return
+	}
+	e := middleware.AuditEvent(r, audit.ActionTokenDeleted)
+	e.TargetType = "access_token"
+	e.TargetID = tokenID.String()
+	recordEvent(h.db, r, e)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "Access token revoked successfully",
+	})
+}
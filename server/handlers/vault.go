@@ -3,25 +3,36 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"time"
 
+	"github.com/google/uuid"
+
+	"password-manager/audit"
+	"password-manager/auth"
+	"password-manager/metrics"
 	"password-manager/middleware"
 	"password-manager/models"
+	"password-manager/notify"
 	"password-manager/utils"
 )
 
 type VaultHandler struct {
-	db *sql.DB
+	db    *sql.DB
+	guard *middleware.VaultGuard
 }
 
-func NewVaultHandler(db *sql.DB) *VaultHandler {
-	return &VaultHandler{db: db}
+func NewVaultHandler(db *sql.DB, guard *middleware.VaultGuard) *VaultHandler {
+	return &VaultHandler{db: db, guard: guard}
 }
 
 // GetVault returns the user's zero-knowledge key material: the KDF salt and the
 // wrapped (encrypted) vault key. Both are useless without the master password,
 // which the server never sees. If the user has not set a master password yet,
-// Initialized is false and the key fields are null.
+// Initialized is false and the key fields are null. If the vault has an auth
+// hash, the wrapped key is left out unless the request presents it; the salt
+// is still returned so the client can derive it.
 func (h *VaultHandler) GetVault(w http.ResponseWriter, r *http.Request) {
 	firebaseUID := middleware.GetFirebaseUID(r)
 	if firebaseUID == "" {
@@ -29,29 +40,42 @@ func (h *VaultHandler) GetVault(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var salt, wrappedKey, hint sql.NullString
-	err := h.db.QueryRow(`
-		SELECT kdf_salt, wrapped_vault_key, master_password_hint
+	var (
+		salt, wrappedKey, hint sql.NullString
+		authRequired           bool
+	)
+	err := h.db.QueryRowContext(r.Context(), `
+		SELECT kdf_salt, wrapped_vault_key, master_password_hint, vault_auth_hash IS NOT NULL
 		FROM users WHERE firebase_uid = $1
-	`, firebaseUID).Scan(&salt, &wrappedKey, &hint)
+	`, firebaseUID).Scan(&salt, &wrappedKey, &hint, &authRequired)
 
 	if err == sql.ErrNoRows {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		serverError(w, r, "Database error", err)
 		return
 	}
 
 	info := models.VaultInfo{
-		Initialized: salt.Valid && wrappedKey.Valid,
+		Initialized:  salt.Valid && wrappedKey.Valid,
+		AuthRequired: authRequired,
 	}
 	if salt.Valid {
 		info.KDFSalt = &salt.String
 	}
 	if wrappedKey.Valid {
-		info.WrappedVaultKey = &wrappedKey.String
+		switch err := h.guard.Verify(r); {
+		case err == nil:
+			info.WrappedVaultKey = &wrappedKey.String
+		case errors.Is(err, middleware.ErrVaultAuthRequired):
+			// Leave the key out; the client derives the auth hash from the
+			// salt and asks again.
+		default:
+			h.guard.WriteError(w, r, err)
+			return
+		}
 	}
 	if hint.Valid {
 		info.MasterPasswordHint = &hint.String
@@ -85,20 +109,29 @@ func (h *VaultHandler) SetupVault(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var authHash *string
+	if req.AuthHash != nil {
+		hashed, ok := hashVaultAuth(w, r, *req.AuthHash)
+		if !ok {
+			return
+		}
+		authHash = &hashed
+	}
+
 	// Only set the key material if it has not been set already.
-	result, err := h.db.Exec(`
+	result, err := h.db.ExecContext(r.Context(), `
 		UPDATE users
-		SET kdf_salt = $1, wrapped_vault_key = $2, master_password_hint = $3, updated_at = NOW()
-		WHERE firebase_uid = $4 AND kdf_salt IS NULL AND wrapped_vault_key IS NULL
-	`, req.KDFSalt, req.WrappedVaultKey, req.MasterPasswordHint, firebaseUID)
+		SET kdf_salt = $1, wrapped_vault_key = $2, master_password_hint = $3, vault_auth_hash = $4, updated_at = NOW()
+		WHERE firebase_uid = $5 AND kdf_salt IS NULL AND wrapped_vault_key IS NULL
+	`, req.KDFSalt, req.WrappedVaultKey, req.MasterPasswordHint, authHash, firebaseUID)
 	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		serverError(w, r, "Database error", err)
 		return
 	}
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
+		serverError(w, r, "Database error", err)
 		return
 	}
 	if rowsAffected == 0 {
@@ -106,6 +139,10 @@ func (h *VaultHandler) SetupVault(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Vault already initialized", http.StatusConflict)
 		return
 	}
+	metrics.VaultsInitialized.Inc()
+	e := middleware.AuditEvent(r, audit.ActionVaultSetup)
+	e.Details = map[string]interface{}{"auth_hash": authHash != nil}
+	recordEvent(h.db, r, e)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -113,3 +150,205 @@ func (h *VaultHandler) SetupVault(w http.ResponseWriter, r *http.Request) {
 		Message: "Vault initialized successfully",
 	})
 }
+
+// SetAuthHash sets the auth hash of a vault that was set up without one, or
+// replaces the existing one, e.g. after the client changes its KDF
+// parameters. The server cannot check a new hash against the master
+// password, so replacing needs the current hash in X-Vault-Auth (checked by
+// the route's VaultGuard), and setting the first one needs a recent sign-in,
+// both on top of step-up. Either way the owner is emailed, so a stolen token
+// alone cannot quietly lock them out. Users who have lost their master
+// password start over with an admin vault reset.
+func (h *VaultHandler) SetAuthHash(w http.ResponseWriter, r *http.Request) {
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// The guard has verified the header if the vault had a hash. Without the
+	// header only a first hash may be set, which also stops a concurrent
+	// request from replacing one set in between.
+	replacing := r.Header.Get(middleware.VaultAuthHeader) != ""
+	if !replacing && !requireRecentAuth(w, r, "protect your vault") {
+		return
+	}
+
+	var req models.SetVaultAuthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := utils.Validate(&req); err != nil {
+		http.Error(w, "Invalid input: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	hashed, ok := hashVaultAuth(w, r, req.AuthHash)
+	if !ok {
+		return
+	}
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var userID uuid.UUID
+	err = tx.QueryRowContext(r.Context(), `
+		UPDATE users
+		SET vault_auth_hash = $1, vault_auth_failed_attempts = 0, vault_auth_locked_until = NULL, updated_at = NOW()
+		WHERE firebase_uid = $2 AND wrapped_vault_key IS NOT NULL AND (vault_auth_hash IS NULL OR $3)
+		RETURNING id
+	`, hashed, firebaseUID, replacing).Scan(&userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Vault is not initialized or already has an auth hash", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	e := middleware.AuditEvent(r, audit.ActionVaultAuthHashSet)
+	e.Details = map[string]interface{}{"replaced": replacing}
+	if err := audit.Record(r.Context(), tx, e); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	// A new hash for the same vault key means the client re-derived it from
+	// a new master password (or new KDF parameters for the same one).
+	kind := notify.KindVaultAuthSet
+	if replacing {
+		kind = notify.KindMasterPasswordChanged
+	}
+	if err := notify.Enqueue(r.Context(), tx, userID, kind, map[string]string{
+		"IP":   middleware.ClientIP(r),
+		"Time": notify.FormatTime(time.Now()),
+	}); err != nil {
+		serverError(w, r, "Failed to queue notification", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "Vault auth hash set successfully",
+	})
+}
+
+// hashVaultAuth decodes a client auth hash and returns its Argon2id hash,
+// writing a 400 if it is malformed.
+func hashVaultAuth(w http.ResponseWriter, r *http.Request, encoded string) (string, bool) {
+	authHash, err := auth.DecodeVaultAuth(encoded)
+	if err != nil {
+		http.Error(w, "Invalid input: auth_hash must be 32 to 64 bytes, base64 encoded", http.StatusBadRequest)
+		return "", false
+	}
+	hashed, err := auth.HashVaultAuth(r.Context(), authHash)
+	if err != nil {
+		serverError(w, r, "Failed to hash auth hash", err)
+		return "", false
+	}
+	return hashed, true
+}
+
+// strengthLabels names the client's 0-4 strength buckets in the health report.
+var strengthLabels = []string{"very_weak", "weak", "fair", "strong", "very_strong"}
+
+// GetHealth reports password reuse, strength and age across the user's vault.
+// It only groups entries by their client-supplied keyed fingerprint, so nothing
+// beyond equality within this one vault is revealed to the server.
+func (h *VaultHandler) GetHealth(w http.ResponseWriter, r *http.Request) {
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := h.db.QueryContext(r.Context(), `
+		SELECT e.id, e.password_fingerprint, e.strength_bucket, e.password_updated_at
+		FROM password_entries e
+		JOIN users u ON u.id = e.user_id
+		WHERE u.firebase_uid = $1
+		ORDER BY e.created_at ASC
+	`, firebaseUID)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	defer rows.Close()
+
+	health := models.VaultHealth{
+		ReuseGroups: []models.ReuseGroup{},
+		ByStrength:  map[string]int{"unknown": 0},
+		ByAge: map[string]int{
+			"under_90_days":  0,
+			"90_to_365_days": 0,
+			"over_365_days":  0,
+		},
+	}
+	for _, label := range strengthLabels {
+		health.ByStrength[label] = 0
+	}
+
+	now := time.Now()
+	groups := map[string][]uuid.UUID{}
+	var order []string
+	for rows.Next() {
+		var (
+			id          uuid.UUID
+			fingerprint sql.NullString
+			strength    sql.NullInt64
+			changedAt   time.Time
+		)
+		if err := rows.Scan(&id, &fingerprint, &strength, &changedAt); err != nil {
+			serverError(w, r, "Database error", err)
+			return
+		}
+		health.TotalEntries++
+
+		if fingerprint.Valid {
+			health.FingerprintedEntries++
+			if _, seen := groups[fingerprint.String]; !seen {
+				order = append(order, fingerprint.String)
+			}
+			groups[fingerprint.String] = append(groups[fingerprint.String], id)
+		}
+
+		if strength.Valid && strength.Int64 >= 0 && int(strength.Int64) < len(strengthLabels) {
+			health.ByStrength[strengthLabels[strength.Int64]]++
+		} else {
+			health.ByStrength["unknown"]++
+		}
+
+		switch age := now.Sub(changedAt); {
+		case age < 90*24*time.Hour:
+			health.ByAge["under_90_days"]++
+		case age < 365*24*time.Hour:
+			health.ByAge["90_to_365_days"]++
+		default:
+			health.ByAge["over_365_days"]++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	for _, fp := range order {
+		if ids := groups[fp]; len(ids) > 1 {
+			health.ReuseGroups = append(health.ReuseGroups, models.ReuseGroup{EntryIDs: ids})
+			health.ReusedEntries += len(ids)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "Vault health retrieved successfully",
+		Data:    health,
+	})
+}
@@ -0,0 +1,525 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"password-manager/audit"
+	"password-manager/auth"
+	"password-manager/metrics"
+	"password-manager/middleware"
+	"password-manager/models"
+	"password-manager/utils"
+)
+
+// WebAuthn ceremonies stored in webauthn_sessions between begin and finish.
+const (
+	ceremonyRegistration = "registration"
+	ceremonyAssertion    = "assertion"
+)
+
+// webauthnUser adapts a users row and its credentials to webauthn.User. The
+// user handle is the account's random UUID, so it reveals nothing about the
+// user.
+type webauthnUser struct {
+	id          uuid.UUID
+	name        string
+	credentials []webauthn.Credential
+}
+
+func (u *webauthnUser) WebAuthnID() []byte                         { return u.id[:] }
+func (u *webauthnUser) WebAuthnName() string                       { return u.name }
+func (u *webauthnUser) WebAuthnDisplayName() string                { return u.name }
+func (u *webauthnUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+// loadWebAuthnUser reads the user and their registered credentials.
+func (h *SecondFactorHandler) loadWebAuthnUser(ctx context.Context, firebaseUID string) (*webauthnUser, error) {
+	var (
+		u     = &webauthnUser{name: firebaseUID}
+		email sql.NullString
+	)
+	if err := h.db.QueryRowContext(ctx, `
+		SELECT id, email FROM users WHERE firebase_uid = $1
+	`, firebaseUID).Scan(&u.id, &email); err != nil {
+		return nil, err
+	}
+	if email.String != "" {
+		u.name = email.String
+	}
+
+	rows, err := h.db.QueryContext(ctx, `
+		SELECT credential FROM webauthn_credentials WHERE user_id = $1
+	`, u.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		var c webauthn.Credential
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return nil, err
+		}
+		u.credentials = append(u.credentials, c)
+	}
+	return u, rows.Err()
+}
+
+// saveSession stores the server side of a ceremony and returns its ID.
+func (h *SecondFactorHandler) saveSession(ctx context.Context, userID uuid.UUID, ceremony string, session *webauthn.SessionData) (uuid.UUID, error) {
+	raw, err := json.Marshal(session)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	expiresAt := session.Expires
+	if expiresAt.IsZero() {
+		expiresAt = time.Now().Add(auth.WebAuthnTimeout)
+	}
+
+	// Abandoned ceremonies are cleared out as new ones start.
+	if _, err := h.db.ExecContext(ctx, `
+		DELETE FROM webauthn_sessions WHERE user_id = $1 AND expires_at <= NOW()
+	`, userID); err != nil {
+		return uuid.Nil, err
+	}
+	var id uuid.UUID
+	err = h.db.QueryRowContext(ctx, `
+		INSERT INTO webauthn_sessions (user_id, ceremony, session, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, userID, ceremony, raw, expiresAt).Scan(&id)
+	return id, err
+}
+
+// takeSession loads and deletes a ceremony, so each challenge can be answered
+// at most once. It returns sql.ErrNoRows for unknown or expired sessions.
+func (h *SecondFactorHandler) takeSession(ctx context.Context, userID uuid.UUID, ceremony string, id uuid.UUID) (*webauthn.SessionData, error) {
+	var raw []byte
+	err := h.db.QueryRowContext(ctx, `
+		DELETE FROM webauthn_sessions
+		WHERE id = $1 AND user_id = $2 AND ceremony = $3 AND expires_at > NOW()
+		RETURNING session
+	`, id, userID, ceremony).Scan(&raw)
+	if err != nil {
+		return nil, err
+	}
+	var session webauthn.SessionData
+	if err := json.Unmarshal(raw, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// decodeFinish reads and validates the body of a finish request.
+func decodeFinish(w http.ResponseWriter, r *http.Request) (*models.FinishWebAuthnRequest, bool) {
+	var req models.FinishWebAuthnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return nil, false
+	}
+	if err := utils.Validate(&req); err != nil {
+		http.Error(w, "Invalid input: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return &req, true
+}
+
+// webauthnReady writes 503 when WebAuthn is not configured.
+func (h *SecondFactorHandler) webauthnReady(w http.ResponseWriter) bool {
+	if h.webauthn == nil {
+		http.Error(w, "WebAuthn is not configured on this server", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// BeginRegistration starts registering a new security key or passkey.
+func (h *SecondFactorHandler) BeginRegistration(w http.ResponseWriter, r *http.Request) {
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !h.webauthnReady(w) {
+		return
+	}
+
+	user, err := h.loadWebAuthnUser(r.Context(), firebaseUID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	// Excluding existing credentials stops the same key being added twice.
+	creation, session, err := h.webauthn.BeginRegistration(user,
+		webauthn.WithExclusions(webauthn.Credentials(user.credentials).CredentialDescriptors()))
+	if err != nil {
+		serverError(w, r, "Failed to start WebAuthn registration", err)
+		return
+	}
+	sessionID, err := h.saveSession(r.Context(), user.id, ceremonyRegistration, session)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "WebAuthn registration started",
+		Data:    models.WebAuthnChallenge{SessionID: sessionID, Options: creation},
+	})
+}
+
+// FinishRegistration verifies the authenticator's attestation and stores the
+// new credential. If this is the account's first second factor, the response
+// carries a fresh set of recovery codes and the account's access tokens are
+// revoked.
+func (h *SecondFactorHandler) FinishRegistration(w http.ResponseWriter, r *http.Request) {
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !h.webauthnReady(w) {
+		return
+	}
+	req, ok := decodeFinish(w, r)
+	if !ok {
+		return
+	}
+	if req.Name == "" {
+		req.Name = "Security key"
+	}
+
+	user, err := h.loadWebAuthnUser(r.Context(), firebaseUID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	session, err := h.takeSession(r.Context(), user.id, ceremonyRegistration, req.SessionID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Unknown or expired WebAuthn session", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(req.Credential)
+	if err != nil {
+		http.Error(w, "Invalid WebAuthn credential", http.StatusBadRequest)
+		return
+	}
+	credential, err := h.webauthn.CreateCredential(user, *session, parsed)
+	if err != nil {
+		http.Error(w, "WebAuthn registration failed", http.StatusBadRequest)
+		return
+	}
+	raw, err := json.Marshal(credential)
+	if err != nil {
+		serverError(w, r, "Failed to store WebAuthn credential", err)
+		return
+	}
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	revoked, err := revokeAccessTokensOnFirstFactor(r.Context(), tx, user.id)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	var created models.RegisteredWebAuthnCredential
+	err = tx.QueryRowContext(r.Context(), `
+		INSERT INTO webauthn_credentials (user_id, name, credential_id, credential)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (credential_id) DO NOTHING
+		RETURNING id, name, created_at
+	`, user.id, req.Name, credential.ID, raw).Scan(&created.ID, &created.Name, &created.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "This credential is already registered", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if created.RecoveryCodes, err = ensureRecoveryCodes(r.Context(), tx, user.id); err != nil {
+		serverError(w, r, "Failed to generate recovery codes", err)
+		return
+	}
+	e := middleware.AuditEvent(r, audit.ActionWebAuthnRegistered)
+	e.TargetType = "webauthn_credential"
+	e.TargetID = created.ID.String()
+	e.Details = map[string]interface{}{"name": created.Name}
+	if revoked > 0 {
+		e.Details["access_tokens_revoked"] = revoked
+	}
+	if err := audit.Record(r.Context(), tx, e); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	message := "WebAuthn credential registered successfully"
+	if created.RecoveryCodes != nil {
+		message = "WebAuthn credential registered. Store these recovery codes safely; they will not be shown again."
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: message,
+		Data:    created,
+	})
+}
+
+// GetCredentials lists the user's registered WebAuthn credentials.
+func (h *SecondFactorHandler) GetCredentials(w http.ResponseWriter, r *http.Request) {
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	rows, err := h.db.QueryContext(r.Context(), `
+		SELECT c.id, c.name, c.last_used_at, c.created_at
+		FROM webauthn_credentials c
+		JOIN users u ON u.id = c.user_id
+		WHERE u.firebase_uid = $1
+		ORDER BY c.created_at ASC
+	`, firebaseUID)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	defer rows.Close()
+
+	credentials := []models.WebAuthnCredential{}
+	for rows.Next() {
+		var c models.WebAuthnCredential
+		if err := rows.Scan(&c.ID, &c.Name, &c.LastUsedAt, &c.CreatedAt); err != nil {
+			serverError(w, r, "Database error", err)
+			return
+		}
+		credentials = append(credentials, c)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "WebAuthn credentials retrieved successfully",
+		Data:    credentials,
+	})
+}
+
+// DeleteCredential removes a WebAuthn credential. Recovery codes are dropped
+// too if no other second factor remains.
+func (h *SecondFactorHandler) DeleteCredential(w http.ResponseWriter, r *http.Request) {
+	credentialID, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid credential ID", http.StatusBadRequest)
+		return
+	}
+
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	tx, err := h.db.BeginTx(r.Context(), nil)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var userID uuid.UUID
+	err = tx.QueryRowContext(r.Context(), `
+		DELETE FROM webauthn_credentials c
+		USING users u
+		WHERE c.id = $1 AND c.user_id = u.id AND u.firebase_uid = $2
+		RETURNING u.id
+	`, credentialID, firebaseUID).Scan(&userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Credential not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if err := dropOrphanedRecoveryCodes(r.Context(), tx, userID); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	e := middleware.AuditEvent(r, audit.ActionWebAuthnRemoved)
+	e.TargetType = "webauthn_credential"
+	e.TargetID = credentialID.String()
+	if err := audit.Record(r.Context(), tx, e); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "WebAuthn credential removed successfully",
+	})
+}
+
+// BeginAssertion starts a WebAuthn second-factor check.
+func (h *SecondFactorHandler) BeginAssertion(w http.ResponseWriter, r *http.Request) {
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !h.webauthnReady(w) {
+		return
+	}
+
+	user, err := h.loadWebAuthnUser(r.Context(), firebaseUID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	if len(user.credentials) == 0 {
+		http.Error(w, "No WebAuthn credentials registered", http.StatusConflict)
+		return
+	}
+
+	assertion, session, err := h.webauthn.BeginLogin(user)
+	if err != nil {
+		serverError(w, r, "Failed to start WebAuthn verification", err)
+		return
+	}
+	sessionID, err := h.saveSession(r.Context(), user.id, ceremonyAssertion, session)
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.SuccessResponse{
+		Message: "WebAuthn verification started",
+		Data:    models.WebAuthnChallenge{SessionID: sessionID, Options: assertion},
+	})
+}
+
+// FinishAssertion verifies the authenticator's signature and returns a
+// step-up token.
+func (h *SecondFactorHandler) FinishAssertion(w http.ResponseWriter, r *http.Request) {
+	firebaseUID := middleware.GetFirebaseUID(r)
+	if firebaseUID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !h.webauthnReady(w) {
+		return
+	}
+	req, ok := decodeFinish(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := h.loadWebAuthnUser(r.Context(), firebaseUID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+	session, err := h.takeSession(r.Context(), user.id, ceremonyAssertion, req.SessionID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Unknown or expired WebAuthn session", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(req.Credential)
+	if err != nil {
+		http.Error(w, "Invalid WebAuthn assertion", http.StatusBadRequest)
+		return
+	}
+	credential, err := h.webauthn.ValidateLogin(user, *session, parsed)
+	if err != nil {
+		h.recordWebAuthnFailure(r, "invalid_assertion")
+		http.Error(w, "WebAuthn verification failed", http.StatusBadRequest)
+		return
+	}
+	// A signature counter that went backwards means the key may have been
+	// cloned; refuse it rather than guess which copy is genuine.
+	if credential.Authenticator.CloneWarning {
+		slog.WarnContext(r.Context(), "WebAuthn clone warning", "user", user.id)
+		h.recordWebAuthnFailure(r, "clone_warning")
+		http.Error(w, "WebAuthn verification failed", http.StatusBadRequest)
+		return
+	}
+
+	raw, err := json.Marshal(credential)
+	if err != nil {
+		serverError(w, r, "Failed to update WebAuthn credential", err)
+		return
+	}
+	if _, err := h.db.ExecContext(r.Context(), `
+		UPDATE webauthn_credentials SET credential = $3, last_used_at = NOW()
+		WHERE user_id = $1 AND credential_id = $2
+	`, user.id, credential.ID, raw); err != nil {
+		serverError(w, r, "Database error", err)
+		return
+	}
+
+	h.issueStepUp(w, r, user.id, "webauthn")
+}
+
+// recordWebAuthnFailure audits a failed WebAuthn second-factor check.
+func (h *SecondFactorHandler) recordWebAuthnFailure(r *http.Request, reason string) {
+	metrics.AuthFailures.WithLabelValues("second_factor_webauthn").Inc()
+	e := middleware.AuditEvent(r, audit.ActionSecondFactorFailed)
+	e.Details = map[string]interface{}{"method": "webauthn", "reason": reason}
+	recordEvent(h.db, r, e)
+}
@@ -0,0 +1,50 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+
+	"password-manager/audit"
+)
+
+// auditSealInterval is how long an audit event may wait to join the hash
+// chain.
+const auditSealInterval = time.Second
+
+// AuditSealer chains audit events written by requests and jobs, so none of
+// them has to hold the chain lock.
+type AuditSealer struct {
+	db *sql.DB
+}
+
+func NewAuditSealer(db *sql.DB) *AuditSealer {
+	return &AuditSealer{db: db}
+}
+
+// Run seals pending events every auditSealInterval until ctx is done,
+// starting with any left from before a restart.
+func (s *AuditSealer) Run(ctx context.Context) {
+	ticker := time.NewTicker(auditSealInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			n, err := audit.Seal(ctx, s.db)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.ErrorContext(ctx, "audit seal failed", "err", err)
+				}
+				break
+			}
+			if n == 0 {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+
+	"password-manager/notify"
+)
+
+const (
+	// outboxInterval is how often queued notifications are looked for.
+	outboxInterval = 10 * time.Second
+	// outboxBatchSize bounds the messages sent in one pass.
+	outboxBatchSize = 50
+	// outboxLease is how long claimed messages are left to the instance that
+	// claimed them before another may send them. It exceeds the worst case of
+	// a whole batch timing out, so it only matters after a crash.
+	outboxLease = 30 * time.Minute
+	// outboxMarkTimeout bounds recording a send's outcome, which is done even
+	// while shutting down so a delivered message is not sent again.
+	outboxMarkTimeout = 5 * time.Second
+	// outboxMaxAttempts failed sends mark a message failed for good. Retries
+	// back off exponentially up to outboxMaxBackoff.
+	outboxMaxAttempts = 8
+	outboxMaxBackoff  = time.Hour
+	// outboxRetention is how long sent, failed and skipped messages are kept.
+	outboxRetention = 30 * 24 * time.Hour
+)
+
+// OutboxSender delivers queued notifications. Delivery is at least once: a
+// crash after a send but before it is marked sent repeats the message once
+// its lease runs out.
+type OutboxSender struct {
+	db       *sql.DB
+	notifier notify.Notifier // nil when notifications are turned off
+}
+
+// NewOutboxSender returns a sender that delivers through notifier. With a nil
+// notifier, queued messages are marked skipped so the outbox does not grow.
+func NewOutboxSender(db *sql.DB, notifier notify.Notifier) *OutboxSender {
+	return &OutboxSender{db: db, notifier: notifier}
+}
+
+// Run sends due messages every outboxInterval until ctx is done.
+func (s *OutboxSender) Run(ctx context.Context) {
+	ticker := time.NewTicker(outboxInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.SendDue(ctx); err != nil {
+			slog.ErrorContext(ctx, "notification outbox failed", "err", err)
+		}
+		if _, err := s.db.ExecContext(ctx, `
+			DELETE FROM notification_outbox
+			WHERE status IN ('sent', 'failed', 'skipped') AND created_at < NOW() - $1 * INTERVAL '1 second'
+		`, int64(outboxRetention.Seconds())); err != nil {
+			slog.ErrorContext(ctx, "notification outbox cleanup failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// outboxMessage is a claimed message.
+type outboxMessage struct {
+	id       string
+	message  notify.Message
+	attempts int
+}
+
+// SendDue sends up to outboxBatchSize due messages and returns how many were
+// sent. Messages are claimed in a short transaction, leased for outboxLease,
+// so several instances can share the outbox without sending a message twice;
+// they are then sent and marked one by one, with no transaction open.
+func (s *OutboxSender) SendDue(ctx context.Context) (int, error) {
+	if s.notifier == nil {
+		_, err := s.db.ExecContext(ctx, `
+			UPDATE notification_outbox SET status = 'skipped' WHERE status IN ('pending', 'sending')
+		`)
+		return 0, err
+	}
+
+	batch, err := s.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for i, q := range batch {
+		if ctx.Err() != nil {
+			s.release(ctx, batch[i:])
+			return sent, ctx.Err()
+		}
+		sendErr := s.notifier.Send(ctx, q.message)
+		if sendErr != nil && ctx.Err() != nil {
+			// Interrupted by shutdown rather than refused by the server.
+			s.release(ctx, batch[i:])
+			return sent, ctx.Err()
+		}
+		if err := s.mark(ctx, q, sendErr); err != nil {
+			return sent, err
+		}
+		if sendErr == nil {
+			sent++
+		}
+	}
+	return sent, nil
+}
+
+// claim leases due messages, including ones whose lease ran out because the
+// instance sending them died.
+func (s *OutboxSender) claim(ctx context.Context) ([]outboxMessage, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		UPDATE notification_outbox
+		SET status = 'sending', next_attempt_at = NOW() + $2 * INTERVAL '1 second'
+		WHERE id IN (
+			SELECT id FROM notification_outbox
+			WHERE status IN ('pending', 'sending') AND next_attempt_at <= NOW()
+			ORDER BY created_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, recipient, subject, body, attempts
+	`, outboxBatchSize, int64(outboxLease.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var batch []outboxMessage
+	for rows.Next() {
+		var q outboxMessage
+		if err := rows.Scan(&q.id, &q.message.To, &q.message.Subject, &q.message.Body, &q.attempts); err != nil {
+			return nil, err
+		}
+		batch = append(batch, q)
+	}
+	return batch, rows.Err()
+}
+
+// mark records the outcome of sending q: sent, or failed and scheduled for a
+// retry with exponential backoff.
+func (s *OutboxSender) mark(ctx context.Context, q outboxMessage, sendErr error) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), outboxMarkTimeout)
+	defer cancel()
+
+	if sendErr == nil {
+		_, err := s.db.ExecContext(ctx, `
+			UPDATE notification_outbox SET status = 'sent', attempts = attempts + 1, sent_at = NOW() WHERE id = $1
+		`, q.id)
+		return err
+	}
+
+	slog.WarnContext(ctx, "failed to send notification", "id", q.id, "attempt", q.attempts+1, "err", sendErr)
+	attempts := q.attempts + 1
+	status := "pending"
+	if attempts >= outboxMaxAttempts {
+		status = "failed"
+	}
+	backoff := time.Minute << q.attempts
+	if backoff > outboxMaxBackoff {
+		backoff = outboxMaxBackoff
+	}
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE notification_outbox
+		SET status = $2, attempts = $3, last_error = $4, next_attempt_at = NOW() + $5 * INTERVAL '1 second'
+		WHERE id = $1
+	`, q.id, status, attempts, sendErr.Error(), int64(backoff.Seconds()))
+	return err
+}
+
+// release hands back messages claimed but not sent, so they are sent at once
+// rather than when their lease runs out.
+func (s *OutboxSender) release(ctx context.Context, batch []outboxMessage) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), outboxMarkTimeout)
+	defer cancel()
+
+	ids := make([]string, len(batch))
+	for i, q := range batch {
+		ids[i] = q.id
+	}
+	if _, err := s.db.ExecContext(ctx, `
+		UPDATE notification_outbox SET status = 'pending', next_attempt_at = NOW()
+		WHERE id = ANY($1) AND status = 'sending'
+	`, pq.Array(ids)); err != nil {
+		slog.ErrorContext(ctx, "failed to release notifications", "err", err)
+	}
+}
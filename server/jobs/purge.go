@@ -0,0 +1,138 @@
+// Package jobs holds background work the server runs on a schedule.
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+
+	"password-manager/audit"
+	"password-manager/auth"
+)
+
+const (
+	// purgeInterval is how often due account deletions are looked for. The
+	// grace period is measured in days, so precision here hardly matters.
+	purgeInterval = time.Hour
+	// purgeBatchSize bounds the work done in one pass.
+	purgeBatchSize = 100
+)
+
+// AccountPurger hard-deletes accounts whose deletion grace period has passed:
+// first the identity-provider account, then the user row, which cascades to
+// everything the user stored.
+type AccountPurger struct {
+	db      *sql.DB
+	deleter auth.IdentityDeleter // nil if the provider cannot delete identities
+}
+
+// NewAccountPurger returns a purger that deletes identities through verifier
+// when the provider supports it.
+func NewAccountPurger(db *sql.DB, verifier auth.TokenVerifier) *AccountPurger {
+	p := &AccountPurger{db: db}
+	p.deleter, _ = verifier.(auth.IdentityDeleter)
+	return p
+}
+
+// Run purges due accounts every purgeInterval until ctx is done.
+func (p *AccountPurger) Run(ctx context.Context) {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+	for {
+		if n, err := p.PurgeDue(ctx); err != nil {
+			slog.ErrorContext(ctx, "account purge failed", "err", err)
+		} else if n > 0 {
+			slog.InfoContext(ctx, "purged deleted accounts", "count", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PurgeDue deletes up to purgeBatchSize accounts whose deletion is due and
+// returns how many it deleted. An account whose identity cannot be deleted is
+// left for the next pass.
+func (p *AccountPurger) PurgeDue(ctx context.Context) (int, error) {
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT firebase_uid FROM users
+		WHERE status = 'pending_deletion' AND deletion_scheduled_at <= NOW()
+		ORDER BY deletion_scheduled_at
+		LIMIT $1
+	`, purgeBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var uids []string
+	for rows.Next() {
+		var uid string
+		if err := rows.Scan(&uid); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		uids = append(uids, uid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, uid := range uids {
+		ok, err := p.purge(ctx, uid)
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to purge account", "user", uid, "err", err)
+			continue
+		}
+		if ok {
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// purge deletes one account. The row stays locked while the identity is
+// deleted, so a cancellation racing the purge either wins before it starts or
+// waits and then finds nothing to cancel.
+func (p *AccountPurger) purge(ctx context.Context, uid string) (bool, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var due bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT status = 'pending_deletion' AND deletion_scheduled_at <= NOW()
+		FROM users WHERE firebase_uid = $1
+		FOR UPDATE
+	`, uid).Scan(&due)
+	if err == sql.ErrNoRows || (err == nil && !due) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if p.deleter != nil {
+		if err := p.deleter.DeleteIdentity(ctx, uid); err != nil {
+			return false, err
+		}
+	} else {
+		slog.WarnContext(ctx, "identity provider cannot delete accounts; remove the account there manually", "uid", uid)
+	}
+
+	var userID uuid.UUID
+	if err := tx.QueryRowContext(ctx, `DELETE FROM users WHERE firebase_uid = $1 RETURNING id`, uid).Scan(&userID); err != nil {
+		return false, err
+	}
+	if err := audit.Record(ctx, tx, audit.Event{UserID: &userID, Action: audit.ActionAccountPurged}); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
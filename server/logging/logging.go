@@ -0,0 +1,103 @@
+// Package logging configures log/slog for the server. Each request carries
+// its ID and, once authenticated, its user ID in the context; every record
+// logged with that context is tagged with both, and with the trace ID when
+// the request is traced, so one request's log lines can be found together.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Setup installs the default logger. format is "json" or "text"; level is
+// "debug", "info", "warn" or "error". Output of the standard log package is
+// routed through it too.
+func Setup(w io.Writer, format, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid LOG_LEVEL %q: %w", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT %q: use json or text", format)
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+	return nil
+}
+
+type contextKey struct{}
+
+// requestFields are the per-request values added to log records. The user ID
+// is filled in by the auth middleware, further down the chain than where the
+// fields are created.
+type requestFields struct {
+	requestID string
+	userID    string
+}
+
+// WithRequestID returns a context whose log records carry id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, &requestFields{requestID: id})
+}
+
+// RequestID returns the request ID stored by WithRequestID.
+func RequestID(ctx context.Context) string {
+	if f, ok := ctx.Value(contextKey{}).(*requestFields); ok {
+		return f.requestID
+	}
+	return ""
+}
+
+// SetUserID tags the request's remaining log records, including its access
+// log line, with uid.
+func SetUserID(ctx context.Context, uid string) {
+	if f, ok := ctx.Value(contextKey{}).(*requestFields); ok {
+		f.userID = uid
+	}
+}
+
+// UserID returns the user ID set by SetUserID.
+func UserID(ctx context.Context) string {
+	if f, ok := ctx.Value(contextKey{}).(*requestFields); ok {
+		return f.userID
+	}
+	return ""
+}
+
+// contextHandler adds the request fields in a record's context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if f, ok := ctx.Value(contextKey{}).(*requestFields); ok {
+		r.AddAttrs(slog.String("request_id", f.requestID))
+		if f.userID != "" {
+			r.AddAttrs(slog.String("user_id", f.userID))
+		}
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -1,113 +1,354 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"password-manager/auth"
+	"password-manager/breach"
+	"password-manager/cli"
 	"password-manager/config"
 	"password-manager/database"
 	"password-manager/handlers"
+	"password-manager/jobs"
+	"password-manager/logging"
+	"password-manager/metrics"
 	"password-manager/middleware"
+	"password-manager/notify"
+	"password-manager/ratelimit"
+	"password-manager/tracing"
 
 	"github.com/gorilla/mux"
-	"golang.org/x/time/rate"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
 )
 
 func main() {
-	// Load configuration
-	cfg := config.Load()
+	// Operator subcommands (e.g. `keyzy breach import`) run and exit without
+	// starting the server. Anything else is server flags.
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(cli.Run(os.Args[1:]))
+	}
+
+	// Load configuration. Logging is not set up yet, so problems go to
+	// stderr as they are.
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "keyzy: invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+	if err := logging.Setup(os.Stderr, cfg.LogFormat, cfg.LogLevel); err != nil {
+		fatal("Invalid logging configuration", err)
+	}
+	slog.Info("effective config", "config", cfg)
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg)
+	if err != nil {
+		fatal("Failed to initialize tracing", err)
+	}
 
 	// Wire runtime config (CORS allowlist, dev-auth flag) into middleware
-	middleware.Configure(cfg)
+	if err := middleware.Configure(cfg); err != nil {
+		fatal("Invalid middleware configuration", err)
+	}
 
-	// Initialize Firebase. Fail closed: if auth can't initialize we refuse to
-	// start, unless the insecure dev bypass has been explicitly enabled.
-	if err := middleware.InitializeFirebase(cfg); err != nil {
+	// Initialize the identity provider. Fail closed: if auth can't initialize
+	// we refuse to start, unless the insecure dev bypass has been explicitly
+	// enabled.
+	verifier, err := auth.NewVerifier(context.Background(), cfg)
+	if err != nil {
 		if cfg.AllowInsecureDevAuth {
-			log.Printf("WARNING: %v", err)
-			log.Printf("WARNING: continuing with ALLOW_INSECURE_DEV_AUTH — DO NOT use in production")
+			slog.Warn("continuing with ALLOW_INSECURE_DEV_AUTH — DO NOT use in production", "err", err)
 		} else {
-			log.Fatalf("Failed to initialize authentication: %v", err)
+			fatal("Failed to initialize authentication", err)
 		}
 	}
-
 	// Initialize database connection
-	db, err := database.Connect(cfg.DatabaseURL)
+	db, err := database.Connect(cfg)
 	if err != nil {
-		log.Fatal("Failed to connect to database:", err)
+		fatal("Failed to connect to database", err)
 	}
 	defer db.Close()
 
 	// Run migrations
 	if err := database.RunMigrations(db); err != nil {
-		log.Fatal("Failed to run migrations:", err)
+		fatal("Failed to run migrations", err)
+	}
+
+	metrics.RegisterDB(db)
+	if v, err := database.SchemaVersion(db); err != nil {
+		fatal("Failed to read schema version", err)
+	} else {
+		metrics.SchemaVersion.Set(float64(v))
+	}
+
+	authenticator := middleware.NewAuthenticator(verifier, db)
+
+	// WebAuthn is optional; without it TOTP is the only second factor.
+	relyingParty, err := auth.NewWebAuthn(cfg)
+	if err != nil {
+		fatal("Failed to initialize WebAuthn", err)
 	}
 
 	// Initialize handlers
 	authHandler := handlers.NewAuthHandler(db)
-	passwordHandler := handlers.NewPasswordHandler(db)
-	vaultHandler := handlers.NewVaultHandler(db)
+	passwordHandler := handlers.NewPasswordHandler(db, handlers.Quota{
+		MaxEntries: cfg.MaxEntriesPerUser,
+		MaxBytes:   cfg.MaxBytesPerUser,
+	})
+	vaultGuard := middleware.NewVaultGuard(db)
+	vaultHandler := handlers.NewVaultHandler(db, vaultGuard)
+	sessionHandler := handlers.NewSessionHandler(db, authenticator)
+	deviceHandler := handlers.NewDeviceHandler(db, authenticator)
+	tokenHandler := handlers.NewAccessTokenHandler(db)
+	secondFactorHandler := handlers.NewSecondFactorHandler(db, relyingParty)
+	accountHandler := handlers.NewAccountHandler(db, authenticator, cfg.AccountDeletionGracePeriod)
+	adminHandler := handlers.NewAdminHandler(db, authenticator)
+	eventHandler := handlers.NewEventHandler(db)
+
+	// Background jobs run until stopJobs is called during shutdown, which
+	// then waits for them to return.
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	var background sync.WaitGroup
+
+	// Security notifications are queued in the database and sent in the
+	// background.
+	notifier, err := notify.New(cfg)
+	if err != nil {
+		fatal("Failed to initialize notifications", err)
+	}
+	if notifier == nil {
+		slog.Warn("NOTIFIER is not set; security notifications will not be sent")
+	}
+	outbox := jobs.NewOutboxSender(db, notifier)
+	background.Go(func() { outbox.Run(jobsCtx) })
+
+	// Write aggregated authentication failures to the audit log.
+	background.Go(func() { authenticator.Run(jobsCtx) })
+
+	// Chain audit events into the tamper-evident log, including any written
+	// before the log was hash-chained.
+	sealer := jobs.NewAuditSealer(db)
+	background.Go(func() { sealer.Run(jobsCtx) })
 
-	// Per-IP rate limiter: 10 req/s, burst 20. Generous for normal use, but
+	// Hard-delete accounts whose deletion grace period has passed.
+	purger := jobs.NewAccountPurger(db, verifier)
+	background.Go(func() { purger.Run(jobsCtx) })
+
+	// Breached-password ranges are served from a locally imported dataset.
+	// Without one the endpoint reports 503 rather than failing startup.
+	var breachStore *breach.Store
+	if cfg.BreachDatasetPath != "" {
+		indexPath := cfg.BreachIndexPath
+		if indexPath == "" {
+			indexPath = breach.DefaultIndexPath(cfg.BreachDatasetPath)
+		}
+		if breachStore, err = breach.Open(cfg.BreachDatasetPath, indexPath); err != nil {
+			slog.Warn("breach lookups disabled", "err", err)
+		} else {
+			defer breachStore.Close()
+		}
+	}
+	breachHandler := handlers.NewBreachHandler(breachStore)
+
+	// Rate limits: a per-IP flood guard, then per-user limits by route,
+	// stricter for the wrapped vault key. Generous for normal use, but
 	// blunts brute-force and abuse.
-	apiLimiter := middleware.NewRateLimiter(rate.Limit(10), 20)
+	limiterPolicies, err := ratelimit.ParsePolicies(cfg.RateLimitPolicies)
+	if err != nil {
+		fatal("Invalid RATE_LIMIT_POLICIES", err)
+	}
+	limiterStore, err := ratelimit.New(cfg, db)
+	if err != nil {
+		fatal("Failed to initialize rate limiting", err)
+	}
+	background.Go(func() { limiterStore.Run(jobsCtx) })
+	apiLimiter := middleware.NewRateLimiter(limiterStore, limiterPolicies)
+
+	healthHandler := handlers.NewHealthHandler(db, verifier, cfg.AllowInsecureDevAuth)
 
 	// Setup router
 	router := mux.NewRouter()
 
-	// Global middleware: security headers, CORS, and a 1 MiB request body cap.
+	// Global middleware: a trace span per route, security headers, CORS, and
+	// a 1 MiB request body cap.
+	router.Use(otelmux.Middleware(tracing.ServiceName))
 	router.Use(middleware.SecurityHeaders)
 	router.Use(middleware.CORS)
 	router.Use(middleware.MaxBodyBytes(1 << 20))
 
-	// Public routes
-	router.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"status": "ok"}`))
-	}).Methods("GET", "OPTIONS")
+	// Public routes. /healthz is the liveness probe and /readyz the readiness
+	// probe; /api/health is kept for existing monitors and reports readiness.
+	// Readiness queries the database, so it is limited by IP like the API.
+	ready := apiLimiter.Middleware(http.HandlerFunc(healthHandler.Ready))
+	router.HandleFunc("/healthz", healthHandler.Live).Methods("GET")
+	router.Handle("/readyz", ready).Methods("GET")
+	router.Handle("/api/health", ready).Methods("GET", "OPTIONS")
+
+	// Prometheus metrics, only on the METRICS_ADDR listener: they name auth
+	// failure reasons and pool stats, which the public port must not expose.
+	var metricsSrv *http.Server
+	if cfg.MetricsAddr != "" {
+		metricsSrv = &http.Server{
+			Addr:              cfg.MetricsAddr,
+			Handler:           metrics.Handler(),
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		go func() {
+			slog.Info("metrics listener starting", "addr", cfg.MetricsAddr)
+			if err := metricsSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				fatal("Metrics listener stopped", err)
+			}
+		}()
+	}
 
 	// Protected routes
 	api := router.PathPrefix("/api").Subrouter()
 
-	// Rate limit then authenticate every API route.
+	// Rate limit by IP, authenticate, then apply the route's rate limit
+	// policy to every API route.
 	api.Use(apiLimiter.Middleware)
-	api.Use(middleware.AuthMiddleware)
+	api.Use(authenticator.Middleware)
+	api.Use(apiLimiter.RouteMiddleware)
 
 	// Register requires a verified token; identity comes from the token, not the body
 	api.HandleFunc("/auth/register", authHandler.Register).Methods("POST", "OPTIONS")
 
-	// User routes
-	api.HandleFunc("/user/profile", authHandler.GetProfile).Methods("GET", "OPTIONS")
+	// User routes. Accounts pending deletion can only view their profile and
+	// cancel the deletion.
+	authenticator.AllowPendingDeletion(api.HandleFunc("/user/profile", authHandler.GetProfile).Methods("GET", "OPTIONS"))
+	authenticator.RequireStepUp(api.HandleFunc("/user", accountHandler.DeleteAccount).Methods("DELETE", "OPTIONS"))
+	authenticator.AllowPendingDeletion(api.HandleFunc("/user/deletion/cancel", accountHandler.CancelDeletion).Methods("POST", "OPTIONS"))
+	api.HandleFunc("/user/usage", passwordHandler.GetUsage).Methods("GET", "OPTIONS")
+	api.HandleFunc("/user/events", eventHandler.GetEvents).Methods("GET", "OPTIONS")
+	api.HandleFunc("/user/sessions/revoke-all", sessionHandler.RevokeAll).Methods("POST", "OPTIONS")
+	api.HandleFunc("/user/devices", deviceHandler.GetDevices).Methods("GET", "OPTIONS")
+	api.HandleFunc("/user/devices/{id}", deviceHandler.RevokeDevice).Methods("DELETE", "OPTIONS")
+	api.HandleFunc("/user/devices/{id}/logins", deviceHandler.GetDeviceLogins).Methods("GET", "OPTIONS")
 
-	// Vault key material (zero-knowledge): salt + wrapped vault key
-	api.HandleFunc("/vault", vaultHandler.GetVault).Methods("GET", "OPTIONS")
+	// Second factors. Verify and the WebAuthn assertion exchange a second
+	// factor for a step-up token, which routes wrapped in RequireStepUp need
+	// in the X-Step-Up-Token header once the user has enrolled a factor.
+	api.HandleFunc("/user/2fa", secondFactorHandler.GetStatus).Methods("GET", "OPTIONS")
+	api.HandleFunc("/user/2fa/verify", secondFactorHandler.Verify).Methods("POST", "OPTIONS")
+	authenticator.RequireStepUp(api.HandleFunc("/user/2fa/totp", secondFactorHandler.EnrollTOTP).Methods("POST", "OPTIONS"))
+	api.HandleFunc("/user/2fa/totp/confirm", secondFactorHandler.ConfirmTOTP).Methods("POST", "OPTIONS")
+	authenticator.RequireStepUp(api.HandleFunc("/user/2fa/totp", secondFactorHandler.DisableTOTP).Methods("DELETE", "OPTIONS"))
+	authenticator.RequireStepUp(api.HandleFunc("/user/2fa/recovery-codes", secondFactorHandler.RegenerateRecoveryCodes).Methods("POST", "OPTIONS"))
+	api.HandleFunc("/user/2fa/webauthn/credentials", secondFactorHandler.GetCredentials).Methods("GET", "OPTIONS")
+	authenticator.RequireStepUp(api.HandleFunc("/user/2fa/webauthn/credentials/{id}", secondFactorHandler.DeleteCredential).Methods("DELETE", "OPTIONS"))
+	authenticator.RequireStepUp(api.HandleFunc("/user/2fa/webauthn/register/begin", secondFactorHandler.BeginRegistration).Methods("POST", "OPTIONS"))
+	api.HandleFunc("/user/2fa/webauthn/register/finish", secondFactorHandler.FinishRegistration).Methods("POST", "OPTIONS")
+	api.HandleFunc("/user/2fa/webauthn/assert/begin", secondFactorHandler.BeginAssertion).Methods("POST", "OPTIONS")
+	api.HandleFunc("/user/2fa/webauthn/assert/finish", secondFactorHandler.FinishAssertion).Methods("POST", "OPTIONS")
+
+	// Personal access tokens for scripts and CI. Management requires an
+	// interactive session; tokens can only call routes given a scope below.
+	api.HandleFunc("/user/tokens", tokenHandler.GetTokens).Methods("GET", "OPTIONS")
+	authenticator.RequireStepUp(api.HandleFunc("/user/tokens", tokenHandler.CreateToken).Methods("POST", "OPTIONS"))
+	api.HandleFunc("/user/tokens/{id}", tokenHandler.DeleteToken).Methods("DELETE", "OPTIONS")
+
+	// Vault key material (zero-knowledge): salt + wrapped vault key. Handing
+	// out the wrapped key needs step-up once the user has a second factor,
+	// and the vault's auth hash once it has one. So does replacing that hash.
+	authenticator.RequireScope(authenticator.RequireStepUp(api.HandleFunc("/vault", vaultHandler.GetVault).Methods("GET", "OPTIONS")), auth.ScopeVaultRead)
 	api.HandleFunc("/vault", vaultHandler.SetupVault).Methods("POST", "OPTIONS")
+	authenticator.RequireStepUp(vaultGuard.Require(api.HandleFunc("/vault/auth-hash", vaultHandler.SetAuthHash).Methods("POST", "OPTIONS")))
+	authenticator.RequireScope(api.HandleFunc("/vault/health", vaultHandler.GetHealth).Methods("GET", "OPTIONS"), auth.ScopeVaultRead)
+
+	// Breached-password k-anonymity lookups (HIBP range API compatible)
+	api.HandleFunc("/breach/range/{prefix}", breachHandler.GetRange).Methods("GET", "OPTIONS")
 
-	// Password routes
-	api.HandleFunc("/passwords", passwordHandler.GetPasswords).Methods("GET", "OPTIONS")
-	api.HandleFunc("/passwords", passwordHandler.CreatePassword).Methods("POST", "OPTIONS")
-	api.HandleFunc("/passwords/{id}", passwordHandler.GetPassword).Methods("GET", "OPTIONS")
-	api.HandleFunc("/passwords/{id}", passwordHandler.UpdatePassword).Methods("PUT", "OPTIONS")
-	api.HandleFunc("/passwords/{id}", passwordHandler.DeletePassword).Methods("DELETE", "OPTIONS")
+	// Password routes. Reads release ciphertext, as do updates, which return
+	// the stored entry, so they need the vault's auth hash if it has one.
+	authenticator.RequireScope(vaultGuard.Require(api.HandleFunc("/passwords", passwordHandler.GetPasswords).Methods("GET", "OPTIONS")), auth.ScopePasswordsRead)
+	authenticator.RequireScope(api.HandleFunc("/passwords", passwordHandler.CreatePassword).Methods("POST", "OPTIONS"), auth.ScopePasswordsWrite)
+	authenticator.RequireScope(vaultGuard.Require(api.HandleFunc("/passwords/{id}", passwordHandler.GetPassword).Methods("GET", "OPTIONS")), auth.ScopePasswordsRead)
+	authenticator.RequireScope(vaultGuard.Require(api.HandleFunc("/passwords/{id}", passwordHandler.UpdatePassword).Methods("PUT", "OPTIONS")), auth.ScopePasswordsWrite)
+	authenticator.RequireScope(api.HandleFunc("/passwords/{id}", passwordHandler.DeletePassword).Methods("DELETE", "OPTIONS"), auth.ScopePasswordsWrite)
+
+	// Admin routes, for operators only (ADMIN_CLAIM or users.role). Every
+	// call is audited; changes also need step-up.
+	admin := api.PathPrefix("/admin").Subrouter()
+	admin.Use(authenticator.RequireAdmin)
+	admin.HandleFunc("/users", adminHandler.ListUsers).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/users/{id}", adminHandler.GetUser).Methods("GET", "OPTIONS")
+	authenticator.RequireStepUp(admin.HandleFunc("/users/{id}/suspend", adminHandler.SuspendUser).Methods("POST", "OPTIONS"))
+	authenticator.RequireStepUp(admin.HandleFunc("/users/{id}/reactivate", adminHandler.ReactivateUser).Methods("POST", "OPTIONS"))
+	authenticator.RequireStepUp(admin.HandleFunc("/users/{id}/vault-reset", adminHandler.ResetVault).Methods("POST", "OPTIONS"))
+	admin.HandleFunc("/stats", adminHandler.GetStats).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/events", adminHandler.ExportEvents).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/audit/verify", adminHandler.VerifyAudit).Methods("GET", "OPTIONS")
+	admin.HandleFunc("/audit/head", adminHandler.GetAuditHead).Methods("GET", "OPTIONS")
 
 	port := cfg.Port
-	if port == "" {
-		port = "8080"
-	}
 
 	// Explicit timeouts protect against slow-client (e.g. Slowloris) attacks and
-	// leaked connections.
+	// leaked connections. Every request gets an ID and an access log line.
 	srv := &http.Server{
 		Addr:              ":" + port,
-		Handler:           router,
-		ReadHeaderTimeout: 5 * time.Second,
-		ReadTimeout:       10 * time.Second,
-		WriteTimeout:      15 * time.Second,
-		IdleTimeout:       60 * time.Second,
+		Handler:           middleware.RequestID(middleware.AccessLog(router)),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
 	}
 
-	log.Printf("Server starting on port %s", port)
-	log.Fatal(srv.ListenAndServe())
+	go func() {
+		slog.Info("server starting", "port", port)
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			fatal("Server stopped", err)
+		}
+	}()
+
+	// Wait for SIGINT or SIGTERM. A second signal kills the process at once.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+
+	// Fail the readiness probe first so load balancers stop sending requests,
+	// then let in-flight ones finish.
+	slog.Info("shutting down", "delay", cfg.ShutdownDelay, "timeout", cfg.ShutdownTimeout)
+	healthHandler.StartDraining()
+	time.Sleep(cfg.ShutdownDelay)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		slog.Warn("requests still running after SHUTDOWN_TIMEOUT were cut off", "err", err)
+		srv.Close()
+	}
+	if metricsSrv != nil {
+		metricsSrv.Close()
+	}
+
+	stopJobs()
+	background.Wait()
+
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFlush()
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Warn("failed to flush traces", "err", err)
+	}
+	slog.Info("server stopped")
+}
+
+// fatal logs err and exits. Deferred calls do not run.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
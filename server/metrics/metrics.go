@@ -0,0 +1,90 @@
+// Package metrics defines the server's Prometheus metrics and serves them
+// for scraping.
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "keyzy"
+
+// registry holds every metric below plus the Go runtime and process
+// collectors. It is separate from prometheus.DefaultRegisterer so libraries
+// cannot add to what is exported.
+var registry = prometheus.NewRegistry()
+
+var factory = promauto.With(registry)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+var (
+	// HTTPRequestDuration is labelled with the mux route template rather
+	// than the path, so entry IDs do not create a series each.
+	HTTPRequestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by method, route template and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	RateLimitRejections = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_rejections_total",
+		Help:      "Requests refused by the rate limiter, by policy.",
+	}, []string{"policy"})
+
+	// AuthFailures uses the reason codes recorded in the audit log, such as
+	// invalid_token or vault_auth_failed.
+	AuthFailures = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failures_total",
+		Help:      "Rejected authentication attempts by reason.",
+	}, []string{"reason"})
+
+	SchemaVersion = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "schema_migration_version",
+		Help:      "Number of the latest applied database migration.",
+	})
+
+	VaultsInitialized = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "vaults_initialized_total",
+		Help:      "Vaults set up with key material.",
+	})
+
+	EntriesCreated = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "entries_created_total",
+		Help:      "Password entries created.",
+	})
+
+	// EntriesDeleted counts entries deleted by their owner or by an admin
+	// vault reset. Entries removed with a purged account are not included.
+	EntriesDeleted = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "entries_deleted_total",
+		Help:      "Password entries deleted.",
+	})
+)
+
+// RegisterDB exports db's connection pool statistics.
+func RegisterDB(db *sql.DB) {
+	registry.MustRegister(collectors.NewDBStatsCollector(db, "keyzy"))
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry})
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+// RequireAdmin only lets operators through: users whose token carries the
+// configured admin claim, or whose users.role is admin. Use it on the admin
+// subrouter, after Middleware. Access tokens are always refused.
+func (a *Authenticator) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if IsAccessTokenRequest(r) {
+			writeJSONError(w, http.StatusForbidden, "access_token_not_allowed", "This endpoint is not available to access tokens")
+			return
+		}
+		if claim, _ := r.Context().Value(ctxAdminClaim).(bool); claim {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		state, err := a.accounts.get(r.Context(), GetFirebaseUID(r))
+		if err != nil {
+			writeAccountError(w, r, err)
+			return
+		}
+		if state.role != RoleAdmin {
+			writeJSONError(w, http.StatusForbidden, "admin_required", "Administrator access required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hasAdminClaim reports whether token claims grant the admin role through the
+// configured claim: true, "admin", or a list containing "admin".
+func hasAdminClaim(claims map[string]interface{}) bool {
+	if adminClaim == "" {
+		return false
+	}
+	switch v := claims[adminClaim].(type) {
+	case bool:
+		return v
+	case string:
+		return v == RoleAdmin
+	case []interface{}:
+		for _, e := range v {
+			if s, _ := e.(string); s == RoleAdmin {
+				return true
+			}
+		}
+	}
+	return false
+}
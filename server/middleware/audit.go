@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"password-manager/audit"
+	"password-manager/metrics"
+)
+
+const (
+	// authFailureFlushInterval is how often aggregated authentication
+	// failures are written to the audit log.
+	authFailureFlushInterval = time.Minute
+	// maxAuthFailureKeys bounds the distinct callers remembered between
+	// flushes. Failures beyond it are still counted, per reason only.
+	maxAuthFailureKeys = 10000
+)
+
+// AuditEvent starts an audit event for action taken by the caller of r,
+// filling in the actor, client IP and user agent.
+func AuditEvent(r *http.Request, action string) audit.Event {
+	return audit.Event{
+		ActorUID:  GetFirebaseUID(r),
+		Action:    action,
+		IP:        ClientIP(r),
+		UserAgent: truncate(r.UserAgent(), 512),
+	}
+}
+
+// authFailureKey groups failures by who failed, how and from where.
+type authFailureKey struct {
+	uid    string
+	reason string
+	ip     string
+}
+
+type authFailureCount struct {
+	count     int
+	path      string
+	userAgent string
+	first     time.Time
+	last      time.Time
+}
+
+// authFailureLog aggregates rejected requests, which anyone can cause with
+// junk tokens, into one audit event per caller and reason each flush, so a
+// flood of them costs neither a row nor a write per request.
+type authFailureLog struct {
+	db     *sql.DB
+	mu     sync.Mutex
+	counts map[authFailureKey]*authFailureCount
+}
+
+func newAuthFailureLog(db *sql.DB) *authFailureLog {
+	return &authFailureLog{db: db, counts: make(map[authFailureKey]*authFailureCount)}
+}
+
+func (l *authFailureLog) add(r *http.Request, uid, reason string) {
+	key := authFailureKey{uid: uid, reason: reason, ip: ClientIP(r)}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.counts[key]
+	if !ok && len(l.counts) >= maxAuthFailureKeys {
+		key = authFailureKey{reason: reason}
+		c, ok = l.counts[key]
+	}
+	if !ok {
+		c = &authFailureCount{path: r.URL.Path, userAgent: truncate(r.UserAgent(), 512), first: now}
+		l.counts[key] = c
+	}
+	c.count++
+	c.last = now
+}
+
+// flush writes one audit event per key counted since the last flush.
+func (l *authFailureLog) flush(ctx context.Context) {
+	l.mu.Lock()
+	counts := l.counts
+	l.counts = make(map[authFailureKey]*authFailureCount)
+	l.mu.Unlock()
+
+	for key, c := range counts {
+		e := audit.Event{
+			ActorUID:  key.uid,
+			Action:    audit.ActionAuthFailed,
+			IP:        key.ip,
+			UserAgent: c.userAgent,
+			Details: map[string]interface{}{
+				"reason":   key.reason,
+				"count":    c.count,
+				"path":     c.path,
+				"first_at": c.first.UTC().Format(time.RFC3339),
+				"last_at":  c.last.UTC().Format(time.RFC3339),
+			},
+		}
+		if err := audit.Record(ctx, l.db, e); err != nil {
+			slog.ErrorContext(ctx, "failed to record audit event", "action", e.Action, "err", err)
+		}
+	}
+}
+
+// recordAuthFailure counts a rejected request for the audit log. uid is
+// empty when the caller could not be identified.
+func (a *Authenticator) recordAuthFailure(r *http.Request, uid, reason string) {
+	metrics.AuthFailures.WithLabelValues(reason).Inc()
+	a.failures.add(r, uid, reason)
+}
+
+// Run writes aggregated authentication failures to the audit log every
+// authFailureFlushInterval until ctx is done, then writes the rest.
+func (a *Authenticator) Run(ctx context.Context) {
+	ticker := time.NewTicker(authFailureFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			a.failures.flush(flushCtx)
+			return
+		case <-ticker.C:
+			a.failures.flush(ctx)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+var (
+	trustedProxies []netip.Prefix
+	clientIPHeader = "X-Forwarded-For"
+)
+
+// configureProxies parses the trusted proxy CIDRs (or single addresses) and
+// the header they report the client in.
+func configureProxies(proxies []string, header string) error {
+	trustedProxies = nil
+	for _, p := range proxies {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(p)
+			if addrErr != nil {
+				return fmt.Errorf("invalid trusted proxy %q: want a CIDR or IP address", p)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		trustedProxies = append(trustedProxies, prefix.Masked())
+	}
+	clientIPHeader = http.CanonicalHeaderKey(header)
+	if clientIPHeader == "" {
+		clientIPHeader = "X-Forwarded-For"
+	}
+	return nil
+}
+
+func trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the client's IP address. Forwarding headers are only
+// believed when the connection comes from a trusted proxy, since anyone else
+// can send them. X-Forwarded-For and Forwarded are walked from the right,
+// skipping trusted proxies: the first hop that is not one is the client, as
+// entries left of it could have been written by the client itself. Any other
+// configured header, such as CF-Connecting-IP, holds the client alone.
+func ClientIP(r *http.Request) string {
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		host, _, splitErr := net.SplitHostPort(r.RemoteAddr)
+		if splitErr != nil {
+			return r.RemoteAddr
+		}
+		return host
+	}
+	client := remote.Addr().Unmap()
+	if !trusted(client) {
+		return client.String()
+	}
+
+	var hops []string
+	switch clientIPHeader {
+	case "X-Forwarded-For":
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+	case "Forwarded":
+		hops = forwardedFor(r.Header.Values("Forwarded"))
+	default:
+		if addr, ok := parseHop(r.Header.Get(clientIPHeader)); ok {
+			return addr.String()
+		}
+		return client.String()
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHop(hops[i])
+		if !ok {
+			// Garbage or an obfuscated identifier: nothing to its left can
+			// be trusted, so the last proxy is the best answer.
+			break
+		}
+		client = addr
+		if !trusted(addr) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// forwardedFor returns the for= parameters of RFC 7239 Forwarded header
+// values, in order.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, v := range values {
+		for _, element := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(name, "for") {
+					hops = append(hops, value)
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// parseHop parses one forwarded address: a bare IP, or as in Forwarded a
+// quoted one, possibly "[IPv6]" and with a port.
+func parseHop(s string) (netip.Addr, bool) {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
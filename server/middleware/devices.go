@@ -0,0 +1,208 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"password-manager/notify"
+)
+
+// DeviceIDHeader carries a stable, client-generated identifier for the
+// browser or client making the request.
+const DeviceIDHeader = "X-Device-ID"
+
+var (
+	deviceIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{8,128}$`)
+
+	errInvalidDeviceID = errors.New("invalid device ID")
+	errDeviceRevoked   = errors.New("device has been revoked")
+)
+
+const (
+	// deviceTouchInterval is how often a device's last_seen is updated, like
+	// access_tokens.last_used_at, so active clients do not write on every
+	// request.
+	deviceTouchInterval = time.Minute
+	// maxDevicesPerUser bounds the devices kept per account. Recording one
+	// more drops the least recently seen device that is not revoked; it is
+	// recorded again if it comes back.
+	maxDevicesPerUser = 50
+	// newDeviceNotifyInterval is the least time between new-device emails
+	// to one account, so a client rotating its device ID cannot flood the
+	// owner's inbox.
+	newDeviceNotifyInterval = time.Hour
+)
+
+// deviceKey names one device of one account.
+type deviceKey struct {
+	uid      string
+	deviceID string
+}
+
+// deviceSeen is when a device was last recorded, and with which auth_time.
+type deviceSeen struct {
+	at       time.Time
+	authTime time.Time
+}
+
+// deviceRegistry records the devices an account is used from.
+type deviceRegistry struct {
+	db   *sql.DB
+	mu   sync.Mutex
+	seen map[deviceKey]deviceSeen
+}
+
+func newDeviceRegistry(db *sql.DB) *deviceRegistry {
+	return &deviceRegistry{db: db, seen: make(map[deviceKey]deviceSeen)}
+}
+
+// touch records a request from the device named in the X-Device-ID header,
+// creating it on first sight and logging a new sign-in when the token's
+// auth_time is newer than any seen from the device before. It returns
+// errDeviceRevoked for devices the user has revoked. A device recorded in
+// the last deviceTouchInterval under the same sign-in is not written again.
+//
+// Requests without the header (older clients, scripts) are not recorded.
+// Revoking a device also revokes the account's tokens, so leaving the header
+// out or sending a new ID does not get around a revocation. Users who have
+// not registered yet have no row to attach a device to and are skipped too.
+func (d *deviceRegistry) touch(ctx context.Context, r *http.Request, uid string, authTime time.Time) error {
+	deviceID := r.Header.Get(DeviceIDHeader)
+	if deviceID == "" {
+		return nil
+	}
+	if !deviceIDPattern.MatchString(deviceID) {
+		return errInvalidDeviceID
+	}
+	key := deviceKey{uid: uid, deviceID: deviceID}
+	if d.recentlySeen(key, authTime) {
+		return nil
+	}
+
+	userAgent := truncate(r.UserAgent(), 512)
+	ip := truncate(ClientIP(r), 64)
+	var authTimeArg interface{}
+	if !authTime.IsZero() {
+		authTimeArg = authTime
+	}
+
+	var (
+		id           string
+		userID       uuid.UUID
+		revoked      bool
+		prevAuthTime sql.NullTime
+		known        bool
+		firstDevice  bool
+	)
+	// prev and others are evaluated against the table as it was before the
+	// upsert. evicted makes room for a device not seen before.
+	err := d.db.QueryRowContext(ctx, `
+		WITH prev AS (
+			SELECT d.last_auth_time
+			FROM devices d JOIN users u ON u.id = d.user_id
+			WHERE u.firebase_uid = $1 AND d.device_id = $2
+		), others AS (
+			SELECT d.id
+			FROM devices d JOIN users u ON u.id = d.user_id
+			WHERE u.firebase_uid = $1
+		), evicted AS (
+			DELETE FROM devices WHERE id IN (
+				SELECT d.id
+				FROM devices d JOIN users u ON u.id = d.user_id
+				WHERE u.firebase_uid = $1 AND d.revoked_at IS NULL AND NOT EXISTS (SELECT 1 FROM prev)
+				ORDER BY d.last_seen DESC
+				OFFSET $6::int - 1
+			)
+		)
+		INSERT INTO devices (user_id, device_id, user_agent, last_ip, last_auth_time)
+		SELECT id, $2::text, $3::text, $4::text, $5::timestamptz FROM users WHERE firebase_uid = $1
+		ON CONFLICT (user_id, device_id) DO UPDATE
+		SET last_seen = NOW(),
+			user_agent = EXCLUDED.user_agent,
+			last_ip = EXCLUDED.last_ip,
+			last_auth_time = GREATEST(devices.last_auth_time, EXCLUDED.last_auth_time)
+		RETURNING id, user_id, revoked_at IS NOT NULL, (SELECT last_auth_time FROM prev),
+			EXISTS (SELECT 1 FROM prev), NOT EXISTS (SELECT 1 FROM others)
+	`, uid, deviceID, userAgent, ip, authTimeArg, maxDevicesPerUser).Scan(&id, &userID, &revoked, &prevAuthTime, &known, &firstDevice)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return errDeviceRevoked
+	}
+	d.remember(key, authTime)
+
+	// Tell the user about devices they have not used before, at most once
+	// per newDeviceNotifyInterval. The first device of an account is the one
+	// it was created from.
+	if !known && !firstDevice {
+		if err := notify.EnqueueThrottled(ctx, d.db, userID, notify.KindNewDevice, newDeviceNotifyInterval, map[string]string{
+			"Device": userAgent,
+			"IP":     ip,
+			"Time":   notify.FormatTime(time.Now()),
+		}); err != nil {
+			slog.ErrorContext(ctx, "failed to queue new device notification", "err", err)
+		}
+	}
+
+	if !authTime.IsZero() && (!prevAuthTime.Valid || authTime.After(prevAuthTime.Time)) {
+		if _, err := d.db.ExecContext(ctx, `
+			INSERT INTO device_logins (device_id, auth_time, ip, user_agent)
+			VALUES ($1, $2, $3, $4)
+		`, id, authTime, ip, userAgent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *deviceRegistry) recentlySeen(key deviceKey, authTime time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	seen, ok := d.seen[key]
+	return ok && time.Since(seen.at) < deviceTouchInterval && !authTime.After(seen.authTime)
+}
+
+func (d *deviceRegistry) remember(key deviceKey, authTime time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.seen[key] = deviceSeen{at: time.Now(), authTime: authTime}
+	// Drop stale entries so the map is bounded by recently active devices.
+	for k, v := range d.seen {
+		if time.Since(v.at) >= deviceTouchInterval {
+			delete(d.seen, k)
+		}
+	}
+}
+
+// forget drops what is remembered about uid's devices, so a revocation
+// applies to the very next request.
+func (d *deviceRegistry) forget(uid string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for k := range d.seen {
+		if k.uid == uid {
+			delete(d.seen, k)
+		}
+	}
+}
+
+// truncate cuts s to at most n bytes without splitting a UTF-8 sequence.
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return strings.ToValidUTF8(s[:n], "")
+	}
+	return s
+}
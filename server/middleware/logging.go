@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"password-manager/logging"
+	"password-manager/metrics"
+)
+
+// RequestIDHeader carries the request's correlation ID, in both directions.
+const RequestIDHeader = "X-Request-ID"
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// RequestID takes the request ID from a proxy's X-Request-ID header, or
+// generates one, echoes it in the response and tags the request's log
+// records with it.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
+
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// AccessLog serves router and logs one line per request with its method,
+// route template (not the raw path, which may hold IDs), status, latency,
+// response size and user ID. The latency is also recorded in
+// metrics.HTTPRequestDuration. Use it inside RequestID.
+func AccessLog(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		router.ServeHTTP(rec, r)
+
+		route := "unmatched"
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route != nil {
+			if tpl, err := match.Route.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		elapsed := time.Since(start)
+		metrics.HTTPRequestDuration.WithLabelValues(metricMethod(r.Method), route, strconv.Itoa(rec.status)).Observe(elapsed.Seconds())
+		slog.InfoContext(r.Context(), "request",
+			"method", r.Method,
+			"route", route,
+			"status", rec.status,
+			"duration_ms", float64(elapsed.Microseconds())/1000,
+			"bytes", rec.bytes,
+		)
+	})
+}
+
+// metricMethod is the method label for metrics. Clients can send any token
+// as a method, so methods the API does not use are all "other", keeping the
+// number of series bounded.
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodHead:
+		return method
+	default:
+		return "other"
+	}
+}
+
+// statusRecorder captures the status code and body size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
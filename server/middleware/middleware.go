@@ -2,17 +2,21 @@ package middleware
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
-	"fmt"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
-	"os"
+	"password-manager/auth"
 	"password-manager/config"
+	"password-manager/logging"
+	"password-manager/models"
+	"password-manager/tracing"
 	"strings"
+	"time"
 
-	firebase "firebase.google.com/go/v4"
-	"firebase.google.com/go/v4/auth"
-	"google.golang.org/api/option"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/codes"
 )
 
 // contextKey is a private type for request-context keys to avoid collisions
@@ -20,25 +24,36 @@ import (
 type contextKey string
 
 const (
-	ctxFirebaseUID contextKey = "firebase_uid"
-	ctxUserEmail   contextKey = "user_email"
+	ctxFirebaseUID   contextKey = "firebase_uid"
+	ctxUserEmail     contextKey = "user_email"
+	ctxEmailVerified contextKey = "email_verified"
+	ctxScopes        contextKey = "scopes"
+	ctxAuthTime      contextKey = "auth_time"
+	ctxAdminClaim    contextKey = "admin_claim"
 )
 
 // Package-level configuration, populated by Configure() before serving.
 var (
 	allowedOrigins       = map[string]bool{}
 	allowInsecureDevAuth = false
+	requireSecondFactor  = false
+	requireVerifiedEmail = false
+	adminClaim           = ""
 )
 
-// Configure wires runtime config (CORS allowlist, dev-auth flag) into the
-// middleware. Call this once at startup before the server starts handling
-// requests.
-func Configure(cfg *config.Config) {
+// Configure wires runtime config (CORS allowlist, dev-auth, second-factor and
+// verified-email flags, admin claim, trusted proxies) into the middleware.
+// Call this once at startup before the server starts handling requests.
+func Configure(cfg *config.Config) error {
 	allowedOrigins = map[string]bool{}
 	for _, o := range cfg.AllowedOrigins {
 		allowedOrigins[o] = true
 	}
 	allowInsecureDevAuth = cfg.AllowInsecureDevAuth
+	requireSecondFactor = cfg.RequireSecondFactor
+	requireVerifiedEmail = cfg.RequireVerifiedEmail
+	adminClaim = cfg.AdminClaim
+	return configureProxies(cfg.TrustedProxies, cfg.ClientIPHeader)
 }
 
 // CORS middleware. Only origins on the configured allowlist are reflected;
@@ -54,7 +69,8 @@ func CORS(next http.Handler) http.Handler {
 		}
 
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Authorization, X-CSRF-Token, X-Requested-With")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Authorization, X-CSRF-Token, X-Requested-With, "+DeviceIDHeader+", "+StepUpHeader+", "+VaultAuthHeader+", "+RequestIDHeader+", Add-Padding, traceparent, tracestate")
+		w.Header().Set("Access-Control-Expose-Headers", RequestIDHeader+", RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After")
 		w.Header().Set("Access-Control-Max-Age", "86400")
 
 		if r.Method == "OPTIONS" {
@@ -66,46 +82,73 @@ func CORS(next http.Handler) http.Handler {
 	})
 }
 
-// Firebase auth client (initialize once)
-var authClient *auth.Client
-
-// InitializeFirebase initializes Firebase auth. It returns an error if the
-// auth client cannot be created; the caller decides whether that is fatal
-// (production) or tolerable (explicit dev mode). It never silently disables
-// authentication.
-func InitializeFirebase(cfg *config.Config) error {
-	ctx := context.Background()
-
-	serviceAccountPath := cfg.GoogleApplicationCredentials
+// Authenticator verifies bearer tokens with the configured TokenVerifier,
+// rejects revoked tokens and inactive accounts, and puts the caller's
+// identity in the request context.
+type Authenticator struct {
+	db                    *sql.DB
+	verifier              auth.TokenVerifier
+	accounts              *accountCache
+	devices               *deviceRegistry
+	failures              *authFailureLog
+	routeScopes           map[*mux.Route]string
+	pendingDeletionRoutes map[*mux.Route]bool
+}
 
-	var app *firebase.App
-	var err error
+// NewAuthenticator returns an Authenticator backed by verifier. A nil verifier
+// means no identity provider could be initialized: every request is refused
+// unless the insecure dev bypass is enabled.
+func NewAuthenticator(verifier auth.TokenVerifier, db *sql.DB) *Authenticator {
+	return &Authenticator{
+		db:          db,
+		verifier:    verifier,
+		accounts:    newAccountCache(db, verifier),
+		devices:     newDeviceRegistry(db),
+		failures:    newAuthFailureLog(db),
+		routeScopes: make(map[*mux.Route]string),
 
-	if serviceAccountPath != "" {
-		if _, statErr := os.Stat(serviceAccountPath); os.IsNotExist(statErr) {
-			return fmt.Errorf("Firebase service account file not found at: %s", serviceAccountPath)
-		}
-		app, err = firebase.NewApp(ctx, nil, option.WithCredentialsFile(serviceAccountPath))
-	} else {
-		log.Printf("No GOOGLE_APPLICATION_CREDENTIALS found, trying default credentials...")
-		app, err = firebase.NewApp(ctx, nil)
+		pendingDeletionRoutes: make(map[*mux.Route]bool),
 	}
+}
 
-	if err != nil {
-		return fmt.Errorf("failed to initialize Firebase app: %w", err)
+// RevokeTokens completes a "sign out everywhere" for uid after the caller has
+// moved users.tokens_valid_after forward: it revokes the provider's refresh
+// tokens when the provider supports it and drops this instance's cached
+// revocation and device state so the change applies to the very next request.
+func (a *Authenticator) RevokeTokens(ctx context.Context, uid string) error {
+	a.accounts.forget(uid)
+	a.devices.forget(uid)
+	if a.accounts.source != nil {
+		return a.accounts.source.RevokeTokens(ctx, uid)
 	}
+	return nil
+}
 
-	authClient, err = app.Auth(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to get Firebase Auth client: %w", err)
-	}
+// ForgetAccount drops this instance's cached state for uid after its status
+// changes, so the change applies to the very next request.
+func (a *Authenticator) ForgetAccount(uid string) {
+	a.accounts.forget(uid)
+}
 
-	log.Printf("Firebase authentication initialized successfully")
-	return nil
+// AllowPendingDeletion lets accounts scheduled for deletion call route, so
+// they can see and cancel the deletion, and returns the route for chaining.
+func (a *Authenticator) AllowPendingDeletion(route *mux.Route) *mux.Route {
+	a.pendingDeletionRoutes[route] = true
+	return route
+}
+
+// checkAccount runs accountCache.check, letting pending-deletion accounts
+// through on the routes that allow them.
+func (a *Authenticator) checkAccount(r *http.Request, uid string, issuedAt time.Time) error {
+	err := a.accounts.check(r.Context(), uid, issuedAt)
+	if errors.Is(err, errAccountPendingDeletion) && a.pendingDeletionRoutes[mux.CurrentRoute(r)] {
+		return nil
+	}
+	return err
 }
 
-// AuthMiddleware validates Firebase JWT tokens
-func AuthMiddleware(next http.Handler) http.Handler {
+// Middleware validates the bearer token on every non-preflight request.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "OPTIONS" {
 			next.ServeHTTP(w, r)
@@ -115,56 +158,176 @@ func AuthMiddleware(next http.Handler) http.Handler {
 		// Get Authorization header
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
-			writeJSONError(w, http.StatusUnauthorized, "Authorization header required")
+			writeJSONError(w, http.StatusUnauthorized, "missing_token", "Authorization header required")
 			return
 		}
 
 		// Extract token
 		tokenParts := strings.Split(authHeader, "Bearer ")
 		if len(tokenParts) != 2 {
-			writeJSONError(w, http.StatusUnauthorized, "Invalid authorization header format")
+			writeJSONError(w, http.StatusUnauthorized, "malformed_token", "Invalid authorization header format")
 			return
 		}
 
 		idToken := tokenParts[1]
 
-		if authClient == nil {
-			// Fail closed: with no Firebase client we cannot verify anyone.
+		// Personal access tokens are checked against the database, not the
+		// identity provider.
+		if auth.IsAccessToken(idToken) {
+			a.serveAccessToken(w, r, next, idToken)
+			return
+		}
+
+		if a.verifier == nil {
+			// Fail closed: with no verifier we cannot authenticate anyone.
 			// The insecure dev bypass is only available when explicitly enabled.
 			if !allowInsecureDevAuth {
-				writeJSONError(w, http.StatusServiceUnavailable, "Authentication is not available")
+				writeJSONError(w, http.StatusServiceUnavailable, "auth_unavailable", "Authentication is not available")
 				return
 			}
-			log.Printf("WARNING: ALLOW_INSECURE_DEV_AUTH is enabled — accepting unverified request as dev user")
+			slog.WarnContext(r.Context(), "ALLOW_INSECURE_DEV_AUTH is enabled — accepting unverified request as dev user")
 			ctx := context.WithValue(r.Context(), ctxFirebaseUID, "dev-firebase-uid")
 			ctx = context.WithValue(ctx, ctxUserEmail, "dev@example.com")
+			ctx = context.WithValue(ctx, ctxEmailVerified, true)
 			next.ServeHTTP(w, r.WithContext(ctx))
 			return
 		}
 
-		// Verify Firebase token
-		token, err := authClient.VerifyIDToken(context.Background(), idToken)
+		// Verify the token with the configured identity provider
+		ctx, span := tracing.Tracer().Start(r.Context(), "auth.verify_token")
+		identity, err := a.verifier.Verify(ctx, idToken)
 		if err != nil {
-			log.Printf("token verification failed: %v", err)
-			writeJSONError(w, http.StatusUnauthorized, "Invalid token")
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+		if err != nil {
+			slog.InfoContext(r.Context(), "token verification failed", "err", err)
+			a.recordAuthFailure(r, "", "invalid_token")
+			writeJSONError(w, http.StatusUnauthorized, "invalid_token", "Invalid token")
+			return
+		}
+
+		if requireVerifiedEmail && !identity.EmailVerified {
+			writeJSONError(w, http.StatusForbidden, "email_not_verified", "Verify your email address to continue")
+			return
+		}
+
+		// Reject tokens issued before the user's last "sign out everywhere"
+		// (or a revocation made at the provider), and accounts that are not
+		// active.
+		if err := a.checkAccount(r, identity.UID, identity.IssuedAt); err != nil {
+			a.auditAccountError(r, identity.UID, err)
+			writeAccountError(w, r, err)
+			return
+		}
+
+		// Record the device and refuse devices the user has revoked, even
+		// while the token itself is still valid.
+		if err := a.devices.touch(r.Context(), r, identity.UID, identity.AuthTime); err != nil {
+			switch {
+			case errors.Is(err, errDeviceRevoked):
+				a.recordAuthFailure(r, identity.UID, "device_revoked")
+				writeJSONError(w, http.StatusForbidden, "device_revoked", "Device has been revoked")
+			case errors.Is(err, errInvalidDeviceID):
+				writeJSONError(w, http.StatusBadRequest, "invalid_device_id", "Invalid "+DeviceIDHeader+" header")
+			default:
+				slog.ErrorContext(r.Context(), "device check failed", "err", err)
+				writeJSONError(w, http.StatusServiceUnavailable, "auth_unavailable", "Authentication is not available")
+			}
 			return
 		}
 
 		// Add user info to context
-		ctx := context.WithValue(r.Context(), ctxFirebaseUID, token.UID)
-		if email, ok := token.Claims["email"].(string); ok {
-			ctx = context.WithValue(ctx, ctxUserEmail, email)
+		logging.SetUserID(r.Context(), identity.UID)
+		ctx = context.WithValue(r.Context(), ctxFirebaseUID, identity.UID)
+		if identity.Email != "" {
+			ctx = context.WithValue(ctx, ctxUserEmail, identity.Email)
+			ctx = context.WithValue(ctx, ctxEmailVerified, identity.EmailVerified)
+		}
+		if !identity.AuthTime.IsZero() {
+			ctx = context.WithValue(ctx, ctxAuthTime, identity.AuthTime)
+		}
+		if hasAdminClaim(identity.Claims) {
+			ctx = context.WithValue(ctx, ctxAdminClaim, true)
 		}
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-// writeJSONError writes a generic JSON error without leaking internal detail.
-func writeJSONError(w http.ResponseWriter, status int, message string) {
+// serveAccessToken authenticates a personal access token and enforces the
+// route's scope before calling next.
+func (a *Authenticator) serveAccessToken(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	ctx, span := tracing.Tracer().Start(r.Context(), "auth.lookup_access_token")
+	t, err := lookupAccessToken(ctx, a.db, token)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	if errors.Is(err, errAccessTokenInvalid) {
+		a.recordAuthFailure(r, "", "invalid_access_token")
+		writeJSONError(w, http.StatusUnauthorized, "invalid_token", "Invalid token")
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "access token lookup failed", "err", err)
+		writeJSONError(w, http.StatusServiceUnavailable, "auth_unavailable", "Authentication is not available")
+		return
+	}
+
+	// "Sign out everywhere" also invalidates access tokens created before it.
+	if err := a.checkAccount(r, t.uid, t.createdAt); err != nil {
+		a.auditAccountError(r, t.uid, err)
+		writeAccountError(w, r, err)
+		return
+	}
+
+	if !a.checkScope(w, r, t.scopes) {
+		return
+	}
+
+	logging.SetUserID(r.Context(), t.uid)
+	ctx = context.WithValue(r.Context(), ctxFirebaseUID, t.uid)
+	if t.email != "" {
+		ctx = context.WithValue(ctx, ctxUserEmail, t.email)
+	}
+	ctx = context.WithValue(ctx, ctxScopes, t.scopes)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// auditAccountError records a failed accountCache.check when it means a
+// credential was refused, rather than an expected state like a pending
+// deletion.
+func (a *Authenticator) auditAccountError(r *http.Request, uid string, err error) {
+	switch {
+	case errors.Is(err, errTokenRevoked):
+		a.recordAuthFailure(r, uid, "token_revoked")
+	case errors.Is(err, errAccountSuspended):
+		a.recordAuthFailure(r, uid, "account_suspended")
+	}
+}
+
+// writeAccountError reports a failed accountCache.check.
+func writeAccountError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errTokenRevoked):
+		writeJSONError(w, http.StatusUnauthorized, "token_revoked", "Token has been revoked")
+	case errors.Is(err, errAccountSuspended):
+		writeJSONError(w, http.StatusForbidden, "account_suspended", "Account is suspended")
+	case errors.Is(err, errAccountPendingDeletion):
+		writeJSONError(w, http.StatusForbidden, "account_pending_deletion", "Account is scheduled for deletion")
+	default:
+		slog.ErrorContext(r.Context(), "account check failed", "err", err)
+		writeJSONError(w, http.StatusServiceUnavailable, "auth_unavailable", "Authentication is not available")
+	}
+}
+
+// writeJSONError writes a JSON error with a stable, machine-readable code and
+// a generic message, without leaking internal detail.
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(map[string]string{"error": message})
+	json.NewEncoder(w).Encode(models.ErrorResponse{Error: message, Code: code})
 }
 
 // GetFirebaseUID returns the verified Firebase UID from the request context.
@@ -175,10 +338,34 @@ func GetFirebaseUID(r *http.Request) string {
 	return ""
 }
 
-// GetUserEmail returns the verified user email from the request context.
+// GetUserEmail returns the user's email from the verified token in the
+// request context. The provider may not have checked that the user owns the
+// address; see EmailVerified.
 func GetUserEmail(r *http.Request) string {
 	if email, ok := r.Context().Value(ctxUserEmail).(string); ok {
 		return email
 	}
 	return ""
 }
+
+// EmailVerified reports whether the identity provider has confirmed that the
+// user owns the address GetUserEmail returns.
+func EmailVerified(r *http.Request) bool {
+	verified, _ := r.Context().Value(ctxEmailVerified).(bool)
+	return verified
+}
+
+// GetAuthTime returns when the user last actively signed in, as reported by
+// the identity provider, or the zero time if unknown (including for access
+// tokens).
+func GetAuthTime(r *http.Request) time.Time {
+	t, _ := r.Context().Value(ctxAuthTime).(time.Time)
+	return t
+}
+
+// IsAccessTokenRequest reports whether the request was authenticated with a
+// personal access token rather than an interactive session.
+func IsAccessTokenRequest(r *http.Request) bool {
+	_, ok := r.Context().Value(ctxScopes).([]string)
+	return ok
+}
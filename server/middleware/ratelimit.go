@@ -1,96 +1,108 @@
 package middleware
 
 import (
-	"net"
+	"log/slog"
 	"net/http"
-	"strings"
-	"sync"
+	"strconv"
 	"time"
 
-	"golang.org/x/time/rate"
+	"github.com/gorilla/mux"
+
+	"password-manager/metrics"
+	"password-manager/ratelimit"
 )
 
-// RateLimiter applies a per-client-IP token bucket. Each IP gets its own
-// limiter; idle entries are evicted periodically so the map can't grow without
-// bound. This blunts brute-force and abuse without any external dependency.
+// RateLimiter enforces ratelimit.Policies. Counts are kept in a
+// ratelimit.LimiterStore, which replicas can share.
 type RateLimiter struct {
-	mu       sync.Mutex
-	visitors map[string]*visitor
-	rate     rate.Limit
-	burst    int
+	store    ratelimit.LimiterStore
+	policies ratelimit.Policies
 }
 
-type visitor struct {
-	limiter  *rate.Limiter
-	lastSeen time.Time
+// NewRateLimiter creates a limiter enforcing policies, counted in store.
+func NewRateLimiter(store ratelimit.LimiterStore, policies ratelimit.Policies) *RateLimiter {
+	return &RateLimiter{store: store, policies: policies}
 }
 
-// NewRateLimiter creates a limiter allowing `r` requests/second per IP with a
-// burst of `b`.
-func NewRateLimiter(r rate.Limit, b int) *RateLimiter {
-	rl := &RateLimiter{
-		visitors: make(map[string]*visitor),
-		rate:     r,
-		burst:    b,
-	}
-	go rl.cleanupLoop()
-	return rl
-}
-
-func (rl *RateLimiter) limiterFor(ip string) *rate.Limiter {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-
-	v, ok := rl.visitors[ip]
-	if !ok {
-		lim := rate.NewLimiter(rl.rate, rl.burst)
-		rl.visitors[ip] = &visitor{limiter: lim, lastSeen: time.Now()}
-		return lim
-	}
-	v.lastSeen = time.Now()
-	return v.limiter
-}
-
-func (rl *RateLimiter) cleanupLoop() {
-	for {
-		time.Sleep(time.Minute)
-		rl.mu.Lock()
-		for ip, v := range rl.visitors {
-			if time.Since(v.lastSeen) > 3*time.Minute {
-				delete(rl.visitors, ip)
-			}
+// Middleware applies the "ip" policy. Use it before authentication, so
+// floods are refused before any token is verified.
+func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy, ok := rl.policies[ratelimit.PolicyIP]
+		if !ok || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
 		}
-		rl.mu.Unlock()
-	}
+		if rl.allow(w, r, ratelimit.PolicyIP, "ip:"+ClientIP(r), policy) {
+			next.ServeHTTP(w, r)
+		}
+	})
 }
 
-// Middleware enforces the rate limit. Preflight requests are exempt.
-func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
+// RouteMiddleware applies the policy of the matched route, or the default
+// policy. Use it after authentication, so per-user policies know the user.
+func (rl *RateLimiter) RouteMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodOptions {
+		route := mux.CurrentRoute(r)
+		if route == nil || r.Method == http.MethodOptions {
 			next.ServeHTTP(w, r)
 			return
 		}
-		if !rl.limiterFor(clientIP(r)).Allow() {
-			writeJSONError(w, http.StatusTooManyRequests, "Too many requests")
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name, policy, ok := rl.policies.Route(r.Method, template)
+		if !ok {
+			next.ServeHTTP(w, r)
 			return
 		}
-		next.ServeHTTP(w, r)
+
+		key := "ip:" + ClientIP(r)
+		if uid := GetFirebaseUID(r); policy.ByUser && uid != "" {
+			key = "user:" + uid
+		}
+		if rl.allow(w, r, name, name+"|"+key, policy) {
+			next.ServeHTTP(w, r)
+		}
 	})
 }
 
-// clientIP returns the best-effort client IP. Behind a trusted reverse proxy the
-// first X-Forwarded-For hop is the real client; otherwise fall back to the
-// connection's remote address.
-func clientIP(r *http.Request) string {
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		if first := strings.TrimSpace(strings.Split(xff, ",")[0]); first != "" {
-			return first
-		}
-	}
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
+// allow counts the request against policy under key and sets the RateLimit
+// headers. If it is refused it writes the 429 and returns false. If the store
+// cannot be reached the request is let through: the limits blunt abuse, and
+// the endpoints that guard secrets have lockouts of their own.
+func (rl *RateLimiter) allow(w http.ResponseWriter, r *http.Request, name, key string, policy ratelimit.Policy) bool {
+	res, err := rl.store.Allow(r.Context(), key, policy.Limit)
 	if err != nil {
-		return r.RemoteAddr
+		slog.ErrorContext(r.Context(), "rate limit check failed", "policy", name, "err", err)
+		return true
+	}
+	setRateLimitHeaders(w, res)
+	if !res.Allowed {
+		metrics.RateLimitRejections.WithLabelValues(name).Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+		writeJSONError(w, http.StatusTooManyRequests, "rate_limited", "Too many requests")
+		return false
+	}
+	return true
+}
+
+// setRateLimitHeaders reports res in the RateLimit-Limit, -Remaining and
+// -Reset headers (draft-ietf-httpapi-ratelimit-headers). When several
+// policies apply, the one with the fewest requests remaining is reported.
+func setRateLimitHeaders(w http.ResponseWriter, res ratelimit.Result) {
+	h := w.Header()
+	if prev, err := strconv.Atoi(h.Get("RateLimit-Remaining")); err == nil && prev <= res.Remaining {
+		return
 	}
-	return host
+	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.ResetAfter)))
+}
+
+// ceilSeconds rounds d up to whole seconds, as the headers require.
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
 }
@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"password-manager/auth"
+)
+
+// accountCacheTTL bounds how long a revocation or status change can take to
+// reach this instance when it was made elsewhere (another replica, or the
+// provider's console). Changes made through this instance invalidate the
+// cache immediately.
+const accountCacheTTL = 30 * time.Second
+
+// Account statuses stored in users.status.
+const (
+	StatusActive          = "active"
+	StatusSuspended       = "suspended"
+	StatusPendingDeletion = "pending_deletion"
+)
+
+// Roles stored in users.role.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+var (
+	// errTokenRevoked is returned when a token predates the account's
+	// revocation time, or the provider has disabled the account.
+	errTokenRevoked = errors.New("token has been revoked")
+	// errAccountSuspended and errAccountPendingDeletion are returned for
+	// accounts whose status is not active.
+	errAccountSuspended       = errors.New("account is suspended")
+	errAccountPendingDeletion = errors.New("account is pending deletion")
+)
+
+// accountState is the per-user data the middleware checks on every request.
+type accountState struct {
+	validAfter time.Time
+	status     string
+	role       string
+	fetched    time.Time
+}
+
+// accountCache keeps recent accountState lookups in memory so revocation
+// checks don't cost a query (or a provider RPC) per request.
+type accountCache struct {
+	db      *sql.DB
+	source  auth.RevocationSource // nil if the provider has no revocation API
+	mu      sync.Mutex
+	entries map[string]accountState
+}
+
+func newAccountCache(db *sql.DB, verifier auth.TokenVerifier) *accountCache {
+	c := &accountCache{db: db, entries: make(map[string]accountState)}
+	c.source, _ = verifier.(auth.RevocationSource)
+	return c
+}
+
+// check returns errTokenRevoked if a token issued at issuedAt has been
+// revoked for uid, or an account status error if uid is not active. Users
+// who have not registered yet count as active.
+func (c *accountCache) check(ctx context.Context, uid string, issuedAt time.Time) error {
+	state, err := c.get(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if issuedAt.Before(state.validAfter) {
+		return errTokenRevoked
+	}
+	switch state.status {
+	case StatusSuspended:
+		return errAccountSuspended
+	case StatusPendingDeletion:
+		return errAccountPendingDeletion
+	}
+	return nil
+}
+
+func (c *accountCache) get(ctx context.Context, uid string) (accountState, error) {
+	c.mu.Lock()
+	state, ok := c.entries[uid]
+	c.mu.Unlock()
+	if ok && time.Since(state.fetched) < accountCacheTTL {
+		return state, nil
+	}
+
+	state, err := c.load(ctx, uid)
+	if err != nil {
+		return accountState{}, err
+	}
+
+	c.mu.Lock()
+	c.entries[uid] = state
+	// Drop expired entries so the map is bounded by recently active users.
+	for k, v := range c.entries {
+		if time.Since(v.fetched) >= accountCacheTTL {
+			delete(c.entries, k)
+		}
+	}
+	c.mu.Unlock()
+	return state, nil
+}
+
+// load reads the account status, role and server-side revocation time and,
+// when the provider tracks revocation too, takes the later of the two times.
+func (c *accountCache) load(ctx context.Context, uid string) (accountState, error) {
+	state := accountState{status: StatusActive, role: RoleUser, fetched: time.Now()}
+
+	var validAfter sql.NullTime
+	err := c.db.QueryRowContext(ctx, `
+		SELECT tokens_valid_after, status, role FROM users WHERE firebase_uid = $1
+	`, uid).Scan(&validAfter, &state.status, &state.role)
+	if err != nil && err != sql.ErrNoRows {
+		return accountState{}, err
+	}
+	if validAfter.Valid {
+		state.validAfter = validAfter.Time
+	}
+
+	if c.source != nil {
+		providerAfter, err := c.source.TokensValidAfter(ctx, uid)
+		if errors.Is(err, auth.ErrUserDisabled) {
+			return accountState{}, errTokenRevoked
+		}
+		if err != nil {
+			return accountState{}, err
+		}
+		if providerAfter.After(state.validAfter) {
+			state.validAfter = providerAfter
+		}
+	}
+	return state, nil
+}
+
+// forget drops the cached state for uid so the next request re-reads it.
+func (c *accountCache) forget(uid string) {
+	c.mu.Lock()
+	delete(c.entries, uid)
+	c.mu.Unlock()
+}
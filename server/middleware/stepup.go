@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"password-manager/auth"
+)
+
+// StepUpHeader carries the token returned by a recent second-factor check.
+const StepUpHeader = "X-Step-Up-Token"
+
+// RequireStepUp makes route require a second-factor check made within the last
+// auth.StepUpTTL, on top of the bearer token, and returns the route for
+// chaining. Users without a second factor pass unless REQUIRE_SECOND_FACTOR
+// is set. Access tokens are exempt: creating one requires step-up once the
+// account has a second factor, and enrolling the first one revokes the
+// tokens created before it.
+func (a *Authenticator) RequireStepUp(route *mux.Route) *mux.Route {
+	route.Handler(a.stepUp(route.GetHandler()))
+	return route
+}
+
+func (a *Authenticator) stepUp(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if IsAccessTokenRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		uid := GetFirebaseUID(r)
+		enrolled, err := hasSecondFactor(r.Context(), a.db, uid)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "second factor lookup failed", "err", err)
+			writeJSONError(w, http.StatusServiceUnavailable, "auth_unavailable", "Authentication is not available")
+			return
+		}
+		if !enrolled {
+			if requireSecondFactor {
+				writeJSONError(w, http.StatusForbidden, "second_factor_required", "Set up a second factor to use this endpoint")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ok, err := validStepUp(r.Context(), a.db, uid, r.Header.Get(StepUpHeader))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "step-up lookup failed", "err", err)
+			writeJSONError(w, http.StatusServiceUnavailable, "auth_unavailable", "Authentication is not available")
+			return
+		}
+		if !ok {
+			writeJSONError(w, http.StatusForbidden, "step_up_required", "Verify your second factor to continue")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hasSecondFactor reports whether uid has a confirmed TOTP secret or a
+// WebAuthn credential.
+func hasSecondFactor(ctx context.Context, db *sql.DB, uid string) (bool, error) {
+	var enrolled bool
+	err := db.QueryRowContext(ctx, `
+		SELECT u.totp_enabled_at IS NOT NULL
+			OR EXISTS (SELECT 1 FROM webauthn_credentials c WHERE c.user_id = u.id)
+		FROM users u WHERE u.firebase_uid = $1
+	`, uid).Scan(&enrolled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enrolled, err
+}
+
+// validStepUp reports whether token is an unexpired step-up token of uid.
+func validStepUp(ctx context.Context, db *sql.DB, uid, token string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+	var ok bool
+	err := db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM step_up_tokens s
+			JOIN users u ON u.id = s.user_id
+			WHERE s.token_hash = $1 AND u.firebase_uid = $2 AND s.expires_at > NOW()
+		)
+	`, auth.HashAccessToken(token), uid).Scan(&ok)
+	return ok, err
+}
@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"password-manager/audit"
+	"password-manager/auth"
+	"password-manager/metrics"
+)
+
+// VaultAuthHeader carries the client's master-password-derived auth hash,
+// base64 encoded.
+const VaultAuthHeader = "X-Vault-Auth"
+
+const (
+	// maxVaultAuthFailures unlock attempts without a success lock the vault for
+	// vaultAuthLockout, so a stolen session cannot guess master passwords
+	// online any faster than it could offline.
+	maxVaultAuthFailures = 10
+	vaultAuthLockout     = 15 * time.Minute
+	// vaultAuthCacheTTL is how long a verified auth hash is remembered, so a
+	// client listing entries doesn't pay for Argon2id on every request.
+	vaultAuthCacheTTL = 10 * time.Minute
+)
+
+var (
+	// ErrVaultAuthRequired is returned when the vault has an auth hash and
+	// the request did not present one.
+	ErrVaultAuthRequired = errors.New("vault auth hash required")
+	errVaultAuthFailed   = errors.New("vault auth hash does not match")
+	errVaultAuthLocked   = errors.New("vault auth is locked")
+)
+
+// vaultAuthEntry remembers a successful verification. It is only reused
+// while the stored hash is unchanged, so setting a new one needs no explicit
+// invalidation.
+type vaultAuthEntry struct {
+	presented [sha256.Size]byte
+	stored    string
+	verified  time.Time
+}
+
+// VaultGuard releases the wrapped vault key and entry ciphertext only to
+// requests that present the vault's auth hash. Vaults set up without one are
+// not gated.
+type VaultGuard struct {
+	db      *sql.DB
+	mu      sync.Mutex
+	entries map[string]vaultAuthEntry
+}
+
+func NewVaultGuard(db *sql.DB) *VaultGuard {
+	return &VaultGuard{db: db, entries: make(map[string]vaultAuthEntry)}
+}
+
+// Require wraps route so it is only served once Verify passes, and returns
+// the route for chaining.
+func (g *VaultGuard) Require(route *mux.Route) *mux.Route {
+	next := route.GetHandler()
+	route.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := g.Verify(r); err != nil {
+			g.WriteError(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+	return route
+}
+
+// Verify checks the request's X-Vault-Auth header against the caller's
+// stored auth hash. It returns nil when the vault has no auth hash,
+// ErrVaultAuthRequired when the header is missing, and another error when
+// the hash is wrong, the vault is locked or the lookup failed.
+func (g *VaultGuard) Verify(r *http.Request) error {
+	uid := GetFirebaseUID(r)
+
+	var (
+		userID string
+		stored sql.NullString
+	)
+	err := g.db.QueryRowContext(r.Context(), `
+		SELECT id, vault_auth_hash FROM users WHERE firebase_uid = $1
+	`, uid).Scan(&userID, &stored)
+	if err == sql.ErrNoRows || (err == nil && !stored.Valid) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	header := r.Header.Get(VaultAuthHeader)
+	if header == "" {
+		return ErrVaultAuthRequired
+	}
+	// A hash verified before a lockout started still works, so a lockout
+	// triggered by someone else does not lock out the owner's open session.
+	presented := sha256.Sum256([]byte(header))
+	if g.cached(uid, presented, stored.String) {
+		return nil
+	}
+
+	authHash, err := auth.DecodeVaultAuth(header)
+	if err != nil {
+		return errVaultAuthFailed
+	}
+	// Count the attempt before hashing, so concurrent guesses cannot all
+	// get past the lockout while their hashes run.
+	if err := g.countAttempt(r, userID); err != nil {
+		return err
+	}
+	ok, err := auth.VerifyVaultAuth(r.Context(), stored.String, authHash)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		metrics.AuthFailures.WithLabelValues("vault_auth_failed").Inc()
+		if err := audit.Record(r.Context(), g.db, AuditEvent(r, audit.ActionVaultAuthFailed)); err != nil {
+			slog.ErrorContext(r.Context(), "failed to record audit event", "action", audit.ActionVaultAuthFailed, "err", err)
+		}
+		return errVaultAuthFailed
+	}
+
+	if _, err := g.db.ExecContext(r.Context(), `
+		UPDATE users SET vault_auth_failed_attempts = 0, vault_auth_locked_until = NULL
+		WHERE id = $1 AND (vault_auth_failed_attempts > 0 OR vault_auth_locked_until IS NOT NULL)
+	`, userID); err != nil {
+		return err
+	}
+	g.remember(uid, presented, stored.String)
+	return nil
+}
+
+// WriteError reports a Verify error with a machine-readable code.
+func (g *VaultGuard) WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrVaultAuthRequired):
+		writeJSONError(w, http.StatusForbidden, "vault_auth_required", "Unlock the vault to continue")
+	case errors.Is(err, errVaultAuthFailed):
+		writeJSONError(w, http.StatusForbidden, "vault_auth_failed", "Incorrect master password")
+	case errors.Is(err, errVaultAuthLocked):
+		w.Header().Set("Retry-After", strconv.Itoa(int(vaultAuthLockout.Seconds())))
+		writeJSONError(w, http.StatusTooManyRequests, "vault_auth_locked", "Too many failed unlock attempts; try again later")
+	default:
+		slog.ErrorContext(r.Context(), "vault auth check failed", "err", err)
+		writeJSONError(w, http.StatusServiceUnavailable, "vault_unavailable", "Vault is not available")
+	}
+}
+
+// countAttempt counts an unlock attempt against the vault, or returns
+// errVaultAuthLocked if it is locked. A lockout starts once there have been
+// maxVaultAuthFailures attempts without a success, which resets the count;
+// the count restarts after each lockout.
+func (g *VaultGuard) countAttempt(r *http.Request, userID string) error {
+	result, err := g.db.ExecContext(r.Context(), `
+		UPDATE users SET
+			vault_auth_failed_attempts = CASE WHEN vault_auth_failed_attempts + 1 >= $2 THEN 0 ELSE vault_auth_failed_attempts + 1 END,
+			vault_auth_locked_until = CASE WHEN vault_auth_failed_attempts + 1 >= $2 THEN NOW() + $3 * INTERVAL '1 second' ELSE vault_auth_locked_until END
+		WHERE id = $1 AND (vault_auth_locked_until IS NULL OR vault_auth_locked_until <= NOW())
+	`, userID, maxVaultAuthFailures, int(vaultAuthLockout.Seconds()))
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errVaultAuthLocked
+	}
+	return nil
+}
+
+func (g *VaultGuard) cached(uid string, presented [sha256.Size]byte, stored string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	e, ok := g.entries[uid]
+	return ok && e.presented == presented && e.stored == stored && time.Since(e.verified) < vaultAuthCacheTTL
+}
+
+func (g *VaultGuard) remember(uid string, presented [sha256.Size]byte, stored string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.entries[uid] = vaultAuthEntry{presented: presented, stored: stored, verified: time.Now()}
+	// Drop expired entries so the map is bounded by recently active users.
+	for k, v := range g.entries {
+		if time.Since(v.verified) >= vaultAuthCacheTTL {
+			delete(g.entries, k)
+		}
+	}
+}
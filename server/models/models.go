@@ -1,17 +1,20 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type User struct {
-	ID          uuid.UUID `json:"id"`
-	FirebaseUID string    `json:"firebase_uid"`
-	Email       string    `json:"email"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID                  uuid.UUID  `json:"id"`
+	FirebaseUID         string     `json:"firebase_uid"`
+	Email               string     `json:"email"`
+	Status              string     `json:"status"`
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
 }
 
 // PasswordEntry holds only client-side ciphertext. The server never sees or
@@ -26,44 +29,311 @@ type PasswordEntry struct {
 	EncryptedUsername *string   `json:"encrypted_username,omitempty"`
 	EncryptedURL      *string   `json:"encrypted_url,omitempty"`
 	EncryptedNotes    *string   `json:"encrypted_notes,omitempty"`
-	CreatedAt         time.Time `json:"created_at"`
-	UpdatedAt         time.Time `json:"updated_at"`
+	// PasswordFingerprint and StrengthBucket are optional health metadata
+	// computed by the client; see VaultHealth.
+	PasswordFingerprint *string   `json:"password_fingerprint,omitempty"`
+	StrengthBucket      *int      `json:"strength_bucket,omitempty"`
+	PasswordUpdatedAt   time.Time `json:"password_updated_at"`
+	CreatedAt           time.Time `json:"created_at"`
+	UpdatedAt           time.Time `json:"updated_at"`
 }
 
 type CreatePasswordRequest struct {
-	ServiceName       string  `json:"service_name" validate:"required,min=1,max=255"`
-	EncryptedPassword string  `json:"encrypted_password" validate:"required,min=1"`
-	EncryptedUsername *string `json:"encrypted_username,omitempty"`
-	EncryptedURL      *string `json:"encrypted_url,omitempty"`
-	EncryptedNotes    *string `json:"encrypted_notes,omitempty"`
+	ServiceName         string  `json:"service_name" validate:"required,min=1,max=255"`
+	EncryptedPassword   string  `json:"encrypted_password" validate:"required,min=1"`
+	EncryptedUsername   *string `json:"encrypted_username,omitempty"`
+	EncryptedURL        *string `json:"encrypted_url,omitempty"`
+	EncryptedNotes      *string `json:"encrypted_notes,omitempty"`
+	PasswordFingerprint *string `json:"password_fingerprint,omitempty" validate:"omitempty,min=16,max=128,printascii"`
+	StrengthBucket      *int    `json:"strength_bucket,omitempty" validate:"omitempty,min=0,max=4"`
 }
 
+// UpdatePasswordRequest changes only the fields that are present. When
+// encrypted_password changes, any fingerprint/strength not resent alongside it
+// is cleared so the health report never describes a previous password.
 type UpdatePasswordRequest struct {
-	ServiceName       string  `json:"service_name,omitempty" validate:"omitempty,min=1,max=255"`
-	EncryptedPassword string  `json:"encrypted_password,omitempty"`
-	EncryptedUsername *string `json:"encrypted_username,omitempty"`
-	EncryptedURL      *string `json:"encrypted_url,omitempty"`
-	EncryptedNotes    *string `json:"encrypted_notes,omitempty"`
+	ServiceName         string  `json:"service_name,omitempty" validate:"omitempty,min=1,max=255"`
+	EncryptedPassword   string  `json:"encrypted_password,omitempty"`
+	EncryptedUsername   *string `json:"encrypted_username,omitempty"`
+	EncryptedURL        *string `json:"encrypted_url,omitempty"`
+	EncryptedNotes      *string `json:"encrypted_notes,omitempty"`
+	PasswordFingerprint *string `json:"password_fingerprint,omitempty" validate:"omitempty,min=16,max=128,printascii"`
+	StrengthBucket      *int    `json:"strength_bucket,omitempty" validate:"omitempty,min=0,max=4"`
 }
 
 // VaultInfo describes a user's zero-knowledge key material. All values are
 // non-secret (the salt) or already encrypted (the wrapped vault key); they are
 // useless without the user's master password.
+//
+// When AuthRequired is set, WrappedVaultKey is only included if the request
+// presented the vault's auth hash in the X-Vault-Auth header.
 type VaultInfo struct {
 	Initialized        bool    `json:"initialized"`
+	AuthRequired       bool    `json:"auth_required"`
 	KDFSalt            *string `json:"kdf_salt,omitempty"`
 	WrappedVaultKey    *string `json:"wrapped_vault_key,omitempty"`
 	MasterPasswordHint *string `json:"master_password_hint,omitempty"`
 }
 
+// SetupVaultRequest stores a new vault's key material. AuthHash is optional:
+// a base64 value the client derives from its master key, separately from the
+// key that unwraps the vault key, which the server then requires before
+// releasing the wrapped key or entry ciphertext.
 type SetupVaultRequest struct {
 	KDFSalt            string  `json:"kdf_salt" validate:"required"`
 	WrappedVaultKey    string  `json:"wrapped_vault_key" validate:"required"`
 	MasterPasswordHint *string `json:"master_password_hint,omitempty"`
+	AuthHash           *string `json:"auth_hash,omitempty" validate:"omitempty,base64"`
 }
 
+// SetVaultAuthRequest adds an auth hash to a vault set up without one.
+type SetVaultAuthRequest struct {
+	AuthHash string `json:"auth_hash" validate:"required,base64"`
+}
+
+// VaultHealth is a zero-knowledge health report built only from client-supplied
+// fingerprints and strength buckets. Fingerprints are keyed per vault, so the
+// server learns which of a user's entries share a password and nothing more.
+type VaultHealth struct {
+	TotalEntries         int            `json:"total_entries"`
+	FingerprintedEntries int            `json:"fingerprinted_entries"`
+	ReusedEntries        int            `json:"reused_entries"`
+	ReuseGroups          []ReuseGroup   `json:"reuse_groups"`
+	ByStrength           map[string]int `json:"by_strength"`
+	ByAge                map[string]int `json:"by_age"`
+}
+
+// ReuseGroup lists entries whose passwords share a fingerprint. The
+// fingerprint itself is not echoed back.
+type ReuseGroup struct {
+	EntryIDs []uuid.UUID `json:"entry_ids"`
+}
+
+// Usage reports an account's storage against its limits. A nil limit means
+// unlimited.
+type Usage struct {
+	Entries    int    `json:"entries"`
+	Bytes      int64  `json:"bytes"`
+	MaxEntries *int   `json:"max_entries"`
+	MaxBytes   *int64 `json:"max_bytes"`
+}
+
+// Device is a browser or client that has made authenticated requests. DeviceID
+// is the identifier the client sends in X-Device-ID; ID is the server's handle
+// used to revoke it.
+type Device struct {
+	ID        uuid.UUID  `json:"id"`
+	DeviceID  string     `json:"device_id"`
+	UserAgent *string    `json:"user_agent,omitempty"`
+	LastIP    *string    `json:"last_ip,omitempty"`
+	FirstSeen time.Time  `json:"first_seen"`
+	LastSeen  time.Time  `json:"last_seen"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// DeviceLogin is one sign-in observed from a device.
+type DeviceLogin struct {
+	AuthTime  time.Time `json:"auth_time"`
+	IP        *string   `json:"ip,omitempty"`
+	UserAgent *string   `json:"user_agent,omitempty"`
+	SeenAt    time.Time `json:"seen_at"`
+}
+
+// AccessToken describes a personal access token. The secret itself is only
+// ever returned once, in CreatedAccessToken.
+type AccessToken struct {
+	ID         uuid.UUID  `json:"id"`
+	Name       string     `json:"name"`
+	Hint       string     `json:"hint"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type CreateAccessTokenRequest struct {
+	Name          string   `json:"name" validate:"required,min=1,max=100"`
+	Scopes        []string `json:"scopes" validate:"required,min=1,unique,dive,oneof=passwords:read passwords:write vault:read"`
+	ExpiresInDays *int     `json:"expires_in_days,omitempty" validate:"omitempty,min=1,max=365"`
+}
+
+// CreatedAccessToken is returned when a token is created. Token is the
+// plaintext secret; the server cannot show it again.
+type CreatedAccessToken struct {
+	AccessToken
+	Token string `json:"token"`
+}
+
+// SecondFactorStatus summarizes the second factors a user has enrolled.
+type SecondFactorStatus struct {
+	Enabled                bool `json:"enabled"`
+	TOTPEnabled            bool `json:"totp_enabled"`
+	WebAuthnAvailable      bool `json:"webauthn_available"`
+	WebAuthnCredentials    int  `json:"webauthn_credentials"`
+	RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+}
+
+// TOTPEnrollment is a pending TOTP secret. It only becomes active once a code
+// generated from it is confirmed.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type ConfirmTOTPRequest struct {
+	Code string `json:"code" validate:"required,len=6,numeric"`
+}
+
+// VerifySecondFactorRequest carries a TOTP code or a recovery code.
+type VerifySecondFactorRequest struct {
+	Code string `json:"code" validate:"required,min=6,max=32"`
+}
+
+// RecoveryCodes are shown once, when generated; only their hashes are kept.
+type RecoveryCodes struct {
+	Codes []string `json:"codes"`
+}
+
+// StepUp is returned by a successful second-factor check. Token goes in the
+// X-Step-Up-Token header of sensitive requests until ExpiresAt.
+type StepUp struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// WebAuthnCredential describes a registered security key or passkey.
+type WebAuthnCredential struct {
+	ID         uuid.UUID  `json:"id"`
+	Name       string     `json:"name"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// RegisteredWebAuthnCredential is returned when a credential is registered.
+// RecoveryCodes is set when this was the account's first second factor.
+type RegisteredWebAuthnCredential struct {
+	WebAuthnCredential
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// WebAuthnChallenge starts a registration or assertion ceremony. Options are
+// passed to navigator.credentials.create() or .get(); SessionID is sent back
+// with the result.
+type WebAuthnChallenge struct {
+	SessionID uuid.UUID   `json:"session_id"`
+	Options   interface{} `json:"options"`
+}
+
+// FinishWebAuthnRequest completes a ceremony. Credential is the
+// PublicKeyCredential returned by the browser, JSON encoded.
+type FinishWebAuthnRequest struct {
+	SessionID  uuid.UUID       `json:"session_id" validate:"required"`
+	Name       string          `json:"name,omitempty" validate:"omitempty,max=100"`
+	Credential json.RawMessage `json:"credential" validate:"required"`
+}
+
+// AccountDeletion describes a scheduled account deletion. The account can be
+// restored until ScheduledAt.
+type AccountDeletion struct {
+	Status      string     `json:"status"`
+	ScheduledAt *time.Time `json:"scheduled_at,omitempty"`
+}
+
+// AdminUser is an operator's view of an account: metadata and usage only,
+// never key material or ciphertext.
+type AdminUser struct {
+	ID                  uuid.UUID  `json:"id"`
+	FirebaseUID         string     `json:"firebase_uid"`
+	Email               string     `json:"email"`
+	Status              string     `json:"status"`
+	Role                string     `json:"role"`
+	VaultInitialized    bool       `json:"vault_initialized"`
+	SecondFactor        bool       `json:"second_factor"`
+	Entries             int        `json:"entries"`
+	Bytes               int64      `json:"bytes"`
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+}
+
+// InstanceStats summarizes the whole instance for operators.
+type InstanceStats struct {
+	Users             int            `json:"users"`
+	UsersByStatus     map[string]int `json:"users_by_status"`
+	Admins            int            `json:"admins"`
+	VaultsInitialized int            `json:"vaults_initialized"`
+	SecondFactorUsers int            `json:"second_factor_users"`
+	Entries           int            `json:"entries"`
+	Bytes             int64          `json:"bytes"`
+	AccessTokens      int            `json:"access_tokens"`
+	Devices           int            `json:"devices"`
+}
+
+// AdminActionRequest is the optional body of admin actions. Reason is kept in
+// the audit record.
+type AdminActionRequest struct {
+	Reason string `json:"reason,omitempty" validate:"max=500"`
+}
+
+// AuditEvent is a recorded security event. Details never hold secrets or
+// ciphertext.
+type AuditEvent struct {
+	ID         int64           `json:"id"`
+	ActorUID   string          `json:"actor_uid,omitempty"`
+	UserID     *uuid.UUID      `json:"user_id,omitempty"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type,omitempty"`
+	TargetID   string          `json:"target_id,omitempty"`
+	IP         string          `json:"ip,omitempty"`
+	UserAgent  string          `json:"user_agent,omitempty"`
+	Details    json.RawMessage `json:"details,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Hash       string          `json:"hash,omitempty"`
+}
+
+// AuditChainHead identifies the latest audit event. Recorded outside the
+// database, it lets a later verification detect events cut off the end.
+type AuditChainHead struct {
+	ID        int64     `json:"id"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AuditChainBreak is the first audit event whose hash or links do not check
+// out.
+type AuditChainBreak struct {
+	ID     int64  `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// AuditVerification is the result of walking the audit chain.
+type AuditVerification struct {
+	Events int64 `json:"events"`
+	// Pending counts events written but not chained yet.
+	Pending int64            `json:"pending"`
+	Head    *AuditChainHead  `json:"head,omitempty"`
+	Broken  *AuditChainBreak `json:"broken,omitempty"`
+}
+
+// HealthStatus is a health probe report. Status is the worst component
+// state, or "draining" while the instance shuts down.
+type HealthStatus struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentHealth `json:"components,omitempty"`
+}
+
+// ComponentHealth is the state of one dependency: "ok", "degraded" (usable,
+// but not as configured for production) or "unavailable". The probes are
+// public, so the reasons are logged rather than returned.
+type ComponentHealth struct {
+	Status string `json:"status"`
+}
+
+// ErrorResponse is the JSON error body. Code is a stable, machine-readable
+// identifier for errors clients are expected to handle.
 type ErrorResponse struct {
 	Error   string `json:"error"`
+	Code    string `json:"code,omitempty"`
 	Message string `json:"message,omitempty"`
 }
 
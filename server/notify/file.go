@@ -0,0 +1,54 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileNotifier appends messages to a local mbox file that any mail client
+// can open, for development and end-to-end tests.
+type FileNotifier struct {
+	path string
+	from string
+	mu   sync.Mutex
+}
+
+func NewFileNotifier(path, from string) *FileNotifier {
+	return &FileNotifier{path: path, from: from}
+}
+
+func (n *FileNotifier) Send(ctx context.Context, m Message) error {
+	now := time.Now()
+	msg, err := format(n.from, m, now)
+	if err != nil {
+		return err
+	}
+
+	// mbox: a "From " separator line, LF line endings, and body lines
+	// starting with "From " quoted so they are not taken for separators.
+	var buf bytes.Buffer
+	buf.WriteString("From " + n.from + " " + now.UTC().Format(time.ANSIC) + "\n")
+	for _, line := range bytes.Split(bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n")), []byte("\n")) {
+		if bytes.HasPrefix(line, []byte("From ")) {
+			buf.WriteByte('>')
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	f, err := os.OpenFile(n.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
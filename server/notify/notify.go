@@ -0,0 +1,219 @@
+// Package notify emails users about security-relevant events on their
+// account. Messages are rendered and queued in the notification_outbox table,
+// in the transaction of the change they report where there is one, and sent
+// later by jobs.OutboxSender, so a crash cannot lose them between the two.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+
+	"password-manager/config"
+)
+
+// Message is a rendered notification.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Notifier delivers messages.
+type Notifier interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// New returns the Notifier selected by cfg.Notifier, or nil when
+// notifications are turned off.
+func New(cfg *config.Config) (Notifier, error) {
+	switch cfg.Notifier {
+	case "":
+		return nil, nil
+	case "smtp":
+		return NewSMTPNotifier(cfg)
+	case "file":
+		return NewFileNotifier(cfg.NotifierFile, senderAddress(cfg.SMTPFrom)), nil
+	default:
+		return nil, fmt.Errorf("unknown NOTIFIER %q: use smtp, file or leave it empty", cfg.Notifier)
+	}
+}
+
+// Kind names a notification template.
+type Kind string
+
+const (
+	KindNewDevice             Kind = "new_device"
+	KindMasterPasswordChanged Kind = "master_password_changed"
+	KindVaultAuthSet          Kind = "vault_auth_set"
+	KindVaultReset            Kind = "vault_reset"
+)
+
+type messageTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+func newTemplate(kind Kind, subject, body string) messageTemplate {
+	return messageTemplate{
+		subject: template.Must(template.New(string(kind)).Option("missingkey=error").Parse(subject)),
+		body:    template.Must(template.New(string(kind)).Option("missingkey=error").Parse(body)),
+	}
+}
+
+var templates = map[Kind]messageTemplate{
+	KindNewDevice: newTemplate(KindNewDevice,
+		"New sign-in to your Keyzy account",
+		`A new device signed in to your Keyzy account.
+
+Device:     {{.Device}}
+IP address: {{.IP}}
+Time:       {{.Time}}
+
+If this was you, there is nothing to do. If it was not, revoke the device
+under Settings > Devices, sign out everywhere and change your master password.
+Further new devices within the hour are listed there but not emailed.
+`),
+	KindMasterPasswordChanged: newTemplate(KindMasterPasswordChanged,
+		"Your Keyzy master password was changed",
+		`The master password of your Keyzy vault was changed.
+
+IP address: {{.IP}}
+Time:       {{.Time}}
+
+If this was you, there is nothing to do. If it was not, sign out everywhere
+and contact your administrator: someone with your old master password may
+have locked you out of your vault.
+`),
+	KindVaultAuthSet: newTemplate(KindVaultAuthSet,
+		"Your Keyzy vault now asks for your master password",
+		`Your Keyzy vault was set to release its encrypted key only to devices
+that prove they know your master password.
+
+IP address: {{.IP}}
+Time:       {{.Time}}
+
+If this was you, there is nothing to do. If it was not, someone with access
+to your account may have locked you out of your vault: sign out everywhere
+and contact your administrator.
+`),
+	KindVaultReset: newTemplate(KindVaultReset,
+		"Your Keyzy vault was reset",
+		`An administrator reset your Keyzy vault on {{.Time}}.
+
+Your saved entries were deleted and you will be asked to set a new master
+password the next time you sign in. If you did not ask for this, contact your
+administrator.
+`),
+}
+
+// Render fills in the template for kind.
+func Render(kind Kind, data map[string]string) (subject, body string, err error) {
+	t, ok := templates[kind]
+	if !ok {
+		return "", "", fmt.Errorf("unknown notification kind %q", kind)
+	}
+	var buf bytes.Buffer
+	if err := t.subject.Execute(&buf, data); err != nil {
+		return "", "", err
+	}
+	subject = buf.String()
+	buf.Reset()
+	if err := t.body.Execute(&buf, data); err != nil {
+		return "", "", err
+	}
+	return subject, buf.String(), nil
+}
+
+// Execer is satisfied by *sql.DB and *sql.Tx.
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Enqueue renders a kind notification and queues it for the user's current
+// email address. Users without an email address are skipped.
+func Enqueue(ctx context.Context, q Execer, userID uuid.UUID, kind Kind, data map[string]string) error {
+	subject, body, err := Render(kind, data)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, `
+		INSERT INTO notification_outbox (user_id, recipient, kind, subject, body)
+		SELECT id, email, $2::text, $3::text, $4::text FROM users WHERE id = $1 AND email <> ''
+	`, userID, string(kind), subject, body)
+	return err
+}
+
+// EnqueueThrottled is Enqueue, except that nothing is queued if a kind
+// notification was already queued for the user within the last interval, so
+// a burst of events sends one message.
+func EnqueueThrottled(ctx context.Context, q Execer, userID uuid.UUID, kind Kind, interval time.Duration, data map[string]string) error {
+	subject, body, err := Render(kind, data)
+	if err != nil {
+		return err
+	}
+	_, err = q.ExecContext(ctx, `
+		INSERT INTO notification_outbox (user_id, recipient, kind, subject, body)
+		SELECT id, email, $2::text, $3::text, $4::text FROM users
+		WHERE id = $1 AND email <> ''
+		  AND NOT EXISTS (
+			SELECT 1 FROM notification_outbox o
+			WHERE o.user_id = $1 AND o.kind = $2 AND o.created_at > NOW() - $5 * INTERVAL '1 second'
+		  )
+	`, userID, string(kind), subject, body, int64(interval.Seconds()))
+	return err
+}
+
+// FormatTime formats t for message bodies.
+func FormatTime(t time.Time) string {
+	return t.UTC().Format("2 Jan 2006 15:04 MST")
+}
+
+// senderAddress falls back to a placeholder sender for the file sink.
+func senderAddress(from string) string {
+	if from == "" {
+		return "keyzy@localhost"
+	}
+	return from
+}
+
+// format builds an RFC 5322 message with CRLF line endings.
+func format(from string, m Message, now time.Time) ([]byte, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	domain := "localhost"
+	if at := strings.LastIndexByte(from, '@'); at >= 0 {
+		domain = strings.TrimSuffix(from[at+1:], ">")
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", m.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id[:]), domain)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(m.Body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
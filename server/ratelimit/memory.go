@@ -0,0 +1,50 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps limits in this process. Each replica enforces its own
+// limits, and they reset on restart.
+type MemoryStore struct {
+	mu   sync.Mutex
+	tats map[string]time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{tats: make(map[string]time.Time)}
+}
+
+func (s *MemoryStore) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	tat, res := gcra(now, s.tats[key], limit)
+	s.tats[key] = tat
+	return res, nil
+}
+
+// Run evicts full buckets every minute until ctx is done, so the map cannot
+// grow without bound.
+func (s *MemoryStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		s.mu.Lock()
+		for key, tat := range s.tats {
+			if tat.Before(now) {
+				delete(s.tats, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,138 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy is a limit and what it is counted per.
+type Policy struct {
+	Limit Limit
+	// ByUser counts requests per authenticated user rather than per client
+	// IP, so users behind one NAT do not share a bucket. Unauthenticated
+	// requests are still counted per IP.
+	ByUser bool
+}
+
+// Policies maps policy names to policies. Two names are special: "ip" is
+// checked per client IP before authentication, and "default" applies to
+// routes without a policy of their own. Other names are a method and mux
+// route template, such as "GET /api/vault".
+type Policies map[string]Policy
+
+// Policy names with special meaning.
+const (
+	PolicyIP      = "ip"
+	PolicyDefault = "default"
+)
+
+// DefaultPolicies are used for names RATE_LIMIT_POLICIES does not set.
+func DefaultPolicies() Policies {
+	return Policies{
+		// A flood guard in front of token verification.
+		PolicyIP:      {Limit: Limit{Rate: 50, Burst: 100}},
+		PolicyDefault: {Limit: Limit{Rate: 10, Burst: 20}, ByUser: true},
+		// Hands out the wrapped vault key.
+		"GET /api/vault": {Limit: Limit{Rate: 5.0 / 60, Burst: 5}, ByUser: true},
+	}
+}
+
+// Route returns the policy for method and route template, falling back to
+// the default policy.
+func (p Policies) Route(method, template string) (string, Policy, bool) {
+	name := method + " " + template
+	if policy, ok := p[name]; ok {
+		return name, policy, true
+	}
+	policy, ok := p[PolicyDefault]
+	return PolicyDefault, policy, ok
+}
+
+// ParsePolicies reads RATE_LIMIT_POLICIES over DefaultPolicies. The spec is
+// a semicolon-separated list of NAME=COUNT/PERIOD[:BURST][:user|ip], e.g.
+//
+//	default=10/1s:20:user; GET /api/vault=5/1m:5:user; ip=50/1s:100
+//
+// BURST defaults to COUNT and the key to ip. A COUNT of 0 removes the
+// policy.
+func ParsePolicies(spec string) (Policies, error) {
+	policies := DefaultPolicies()
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		name = strings.Join(strings.Fields(name), " ")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("rate limit policy %q: want NAME=COUNT/PERIOD[:BURST][:user|ip]", entry)
+		}
+		policy, err := parsePolicy(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("rate limit policy %q: %w", name, err)
+		}
+		if name == PolicyIP && policy.ByUser {
+			return nil, fmt.Errorf("rate limit policy %q: is checked before authentication, so it cannot be per user", name)
+		}
+		if policy.Limit.Burst == 0 {
+			delete(policies, name)
+			continue
+		}
+		policies[name] = policy
+	}
+	return policies, nil
+}
+
+func parsePolicy(value string) (Policy, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) > 3 {
+		return Policy{}, fmt.Errorf("too many fields in %q", value)
+	}
+
+	countStr, periodStr, ok := strings.Cut(parts[0], "/")
+	if !ok {
+		return Policy{}, fmt.Errorf("rate %q must be COUNT/PERIOD, e.g. 10/1s", parts[0])
+	}
+	count, err := strconv.Atoi(countStr)
+	if err != nil || count < 0 {
+		return Policy{}, fmt.Errorf("invalid count %q", countStr)
+	}
+	period, err := time.ParseDuration(periodStr)
+	if err != nil || period <= 0 {
+		return Policy{}, fmt.Errorf("invalid period %q", periodStr)
+	}
+
+	policy := Policy{Limit: Limit{Rate: float64(count) / period.Seconds(), Burst: count}}
+	for _, field := range parts[1:] {
+		switch field {
+		case "user":
+			policy.ByUser = true
+		case "ip":
+			policy.ByUser = false
+		default:
+			burst, err := strconv.Atoi(field)
+			if err != nil || burst < 1 {
+				return Policy{}, fmt.Errorf("invalid burst %q", field)
+			}
+			policy.Limit.Burst = burst
+		}
+	}
+	if count == 0 {
+		policy.Limit.Burst = 0
+		return policy, nil
+	}
+
+	// The stores count in whole microseconds, and the tolerance, a full
+	// burst of intervals, must fit in a time.Duration.
+	interval := float64(time.Second) / policy.Limit.Rate
+	if interval < float64(time.Microsecond) {
+		return Policy{}, fmt.Errorf("rate %q is too fast: allow at most one request per microsecond", parts[0])
+	}
+	if interval*float64(policy.Limit.Burst) >= math.MaxInt64 {
+		return Policy{}, fmt.Errorf("rate %q is too slow for a burst of %d", parts[0], policy.Limit.Burst)
+	}
+	return policy, nil
+}
@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePolicies(t *testing.T) {
+	policies, err := ParsePolicies("default=10/1s:20:user; GET /api/vault=5/1m:5; login=0/1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := policies[PolicyDefault], (Policy{Limit: Limit{Rate: 10, Burst: 20}, ByUser: true}); got != want {
+		t.Errorf("default: got %+v, want %+v", got, want)
+	}
+	if got := policies["GET /api/vault"]; got.Limit.Burst != 5 || got.Limit.interval() != 12*time.Second || got.ByUser {
+		t.Errorf("GET /api/vault: got %+v, want 5 per minute per IP", got)
+	}
+	if _, ok := policies["login"]; ok {
+		t.Error("login: a zero count should remove the policy")
+	}
+}
+
+func TestParsePoliciesErrors(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"default", "want NAME=COUNT/PERIOD"},
+		{"default=10", "must be COUNT/PERIOD"},
+		{"default=-1/1s", "invalid count"},
+		{"default=10/0s", "invalid period"},
+		{"default=10/1s:0", "invalid burst"},
+		{"default=10/1s:5:user:ip", "too many fields"},
+		{"ip=10/1s:user", "cannot be per user"},
+		{"default=2000000000/1ns", "too fast"},
+		{"default=2/1us", "too fast"},
+		{"default=1/2540000h:2", "too slow"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			_, err := ParsePolicies(tt.spec)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
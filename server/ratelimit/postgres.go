@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// PostgresStore keeps limits in the rate_limit_buckets table, shared by every
+// replica using the database. The database clock is used throughout, so
+// replicas with skewed clocks still agree.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+func (s *PostgresStore) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	interval := limit.interval().Microseconds()
+	tolerance := limit.tolerance().Microseconds()
+
+	// The upsert only writes, and so only returns a row, when the request is
+	// allowed. The row lock taken by ON CONFLICT makes concurrent requests
+	// for a key apply one after the other.
+	var tat, now time.Time
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO rate_limit_buckets AS b (key, tat)
+		VALUES ($1, NOW() + $2::bigint * INTERVAL '1 microsecond')
+		ON CONFLICT (key) DO UPDATE
+		SET tat = GREATEST(b.tat, NOW()) + $2 * INTERVAL '1 microsecond'
+		WHERE GREATEST(b.tat, NOW()) + ($2 - $3::bigint) * INTERVAL '1 microsecond' <= NOW()
+		RETURNING tat, NOW()
+	`, key, interval, tolerance).Scan(&tat, &now)
+	if err == nil {
+		return allowed(now, tat, limit), nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return Result{}, err
+	}
+
+	err = s.db.QueryRowContext(ctx, `
+		SELECT tat, NOW() FROM rate_limit_buckets WHERE key = $1
+	`, key).Scan(&tat, &now)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Cleaned up in between, so the bucket has refilled.
+		return s.Allow(ctx, key, limit)
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	return denied(now, tat, limit), nil
+}
+
+// Run deletes full buckets every minute until ctx is done.
+func (s *PostgresStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM rate_limit_buckets WHERE tat < NOW()`); err != nil {
+			slog.ErrorContext(ctx, "rate limit cleanup failed", "err", err)
+		}
+	}
+}
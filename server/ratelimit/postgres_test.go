@@ -0,0 +1,32 @@
+package ratelimit
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	_ "github.com/lib/pq"
+
+	"password-manager/database"
+)
+
+// testDatabaseEnv names a throwaway Postgres database for the store tests,
+// which are skipped without it. Migrations are applied to it.
+const testDatabaseEnv = "KEYZY_TEST_DATABASE_URL"
+
+func TestPostgresStore(t *testing.T) {
+	url := os.Getenv(testDatabaseEnv)
+	if url == "" {
+		t.Skip(testDatabaseEnv + " is not set")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := database.RunMigrations(db); err != nil {
+		t.Fatal(err)
+	}
+
+	testStore(t, NewPostgresStore(db))
+}
@@ -0,0 +1,112 @@
+// Package ratelimit implements the generic cell rate algorithm (GCRA) over
+// interchangeable stores: in memory for a single instance, or Postgres or a
+// Redis-protocol server so that replicas share their limits.
+//
+// GCRA keeps one timestamp per key, the theoretical arrival time (TAT) at
+// which the bucket would be full again, which makes it cheap to store and
+// to update atomically.
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"password-manager/config"
+)
+
+// Limit allows Burst requests at once, refilling at Rate requests per second.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// interval is the time it takes to earn one request.
+func (l Limit) interval() time.Duration {
+	return time.Duration(float64(time.Second) / l.Rate)
+}
+
+// tolerance is how far the TAT may run ahead of now: a full burst.
+func (l Limit) tolerance() time.Duration {
+	return l.interval() * time.Duration(l.Burst)
+}
+
+// Result is the outcome of a request against a limit.
+type Result struct {
+	Allowed bool
+	// Limit is the burst size, the most requests allowed at once.
+	Limit int
+	// Remaining is how many more requests would be allowed right now.
+	Remaining int
+	// ResetAfter is how long until the bucket is full again.
+	ResetAfter time.Duration
+	// RetryAfter is how long until a request will be allowed again; zero
+	// when this one was.
+	RetryAfter time.Duration
+}
+
+// LimiterStore counts requests against limits.
+type LimiterStore interface {
+	// Allow takes one request from key's bucket under limit.
+	Allow(ctx context.Context, key string, limit Limit) (Result, error)
+	// Run does the store's housekeeping until ctx is done, then releases
+	// its resources.
+	Run(ctx context.Context)
+}
+
+// New returns the store selected by cfg.RateLimitStore: "memory" (the
+// default), "postgres" (using db) or "redis".
+func New(cfg *config.Config, db *sql.DB) (LimiterStore, error) {
+	switch cfg.RateLimitStore {
+	case "", "memory":
+		return NewMemoryStore(), nil
+	case "postgres":
+		return NewPostgresStore(db), nil
+	case "redis":
+		if cfg.RateLimitRedisURL == "" {
+			return nil, fmt.Errorf("RATE_LIMIT_STORE=redis needs RATE_LIMIT_REDIS_URL")
+		}
+		return NewRedisStore(cfg.RateLimitRedisURL)
+	default:
+		return nil, fmt.Errorf("unknown RATE_LIMIT_STORE %q: use memory, postgres or redis", cfg.RateLimitStore)
+	}
+}
+
+// allowed reports the result of a request that moved key's TAT to tat.
+func allowed(now, tat time.Time, limit Limit) Result {
+	return Result{
+		Allowed:    true,
+		Limit:      limit.Burst,
+		Remaining:  int(now.Sub(tat.Add(-limit.tolerance())) / limit.interval()),
+		ResetAfter: tat.Sub(now),
+	}
+}
+
+// denied reports the result of a request refused while key's TAT was tat.
+// A store that reads tat after refusing may see it already within reach, so
+// RetryAfter is never negative.
+func denied(now, tat time.Time, limit Limit) Result {
+	if tat.Before(now) {
+		tat = now
+	}
+	return Result{
+		Limit:      limit.Burst,
+		ResetAfter: tat.Sub(now),
+		RetryAfter: max(tat.Add(limit.interval()-limit.tolerance()).Sub(now), 0),
+	}
+}
+
+// gcra applies one request at now to a key whose TAT is tat (zero for a new
+// key). It returns the key's new TAT, which is unchanged if the request is
+// refused.
+func gcra(now, tat time.Time, limit Limit) (time.Time, Result) {
+	if tat.Before(now) {
+		tat = now
+	}
+	next := tat.Add(limit.interval())
+	if next.Add(-limit.tolerance()).After(now) {
+		return tat, denied(now, tat, limit)
+	}
+	return next, allowed(now, next, limit)
+}
@@ -0,0 +1,173 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestGCRA(t *testing.T) {
+	type step struct {
+		at        time.Duration // since epoch
+		allowed   bool
+		remaining int
+		reset     time.Duration
+		retry     time.Duration
+	}
+	tests := []struct {
+		name  string
+		limit Limit
+		steps []step
+	}{
+		{
+			name:  "burst then denied",
+			limit: Limit{Rate: 1, Burst: 3},
+			steps: []step{
+				{at: 0, allowed: true, remaining: 2, reset: time.Second},
+				{at: 0, allowed: true, remaining: 1, reset: 2 * time.Second},
+				{at: 0, allowed: true, remaining: 0, reset: 3 * time.Second},
+				{at: 0, allowed: false, reset: 3 * time.Second, retry: time.Second},
+				{at: 0, allowed: false, reset: 3 * time.Second, retry: time.Second},
+			},
+		},
+		{
+			name:  "refills one request per interval",
+			limit: Limit{Rate: 2, Burst: 2},
+			steps: []step{
+				{at: 0, allowed: true, remaining: 1, reset: 500 * time.Millisecond},
+				{at: 0, allowed: true, remaining: 0, reset: time.Second},
+				{at: 250 * time.Millisecond, allowed: false, reset: 750 * time.Millisecond, retry: 250 * time.Millisecond},
+				{at: 500 * time.Millisecond, allowed: true, remaining: 0, reset: time.Second},
+				{at: 500 * time.Millisecond, allowed: false, reset: time.Second, retry: 500 * time.Millisecond},
+			},
+		},
+		{
+			name:  "idle key refills to the burst, no further",
+			limit: Limit{Rate: 1, Burst: 2},
+			steps: []step{
+				{at: 0, allowed: true, remaining: 1, reset: time.Second},
+				{at: 0, allowed: true, remaining: 0, reset: 2 * time.Second},
+				{at: time.Hour, allowed: true, remaining: 1, reset: time.Second},
+				{at: time.Hour, allowed: true, remaining: 0, reset: 2 * time.Second},
+				{at: time.Hour, allowed: false, reset: 2 * time.Second, retry: time.Second},
+			},
+		},
+		{
+			name:  "slow rate",
+			limit: Limit{Rate: 0.5, Burst: 1},
+			steps: []step{
+				{at: 0, allowed: true, remaining: 0, reset: 2 * time.Second},
+				{at: time.Second, allowed: false, reset: time.Second, retry: time.Second},
+				{at: 2 * time.Second, allowed: true, remaining: 0, reset: 2 * time.Second},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tat time.Time
+			for i, s := range tt.steps {
+				var res Result
+				tat, res = gcra(epoch.Add(s.at), tat, tt.limit)
+				want := Result{
+					Allowed:    s.allowed,
+					Limit:      tt.limit.Burst,
+					Remaining:  s.remaining,
+					ResetAfter: s.reset,
+					RetryAfter: s.retry,
+				}
+				if res != want {
+					t.Fatalf("step %d: got %+v, want %+v", i, res, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	limit := Limit{Rate: 1, Burst: 5}
+	tests := []struct {
+		name string
+		tat  time.Duration // since now
+		want Result
+	}{
+		{"first request", time.Second, Result{Allowed: true, Limit: 5, Remaining: 4, ResetAfter: time.Second}},
+		{"last of the burst", 5 * time.Second, Result{Allowed: true, Limit: 5, Remaining: 0, ResetAfter: 5 * time.Second}},
+		{"partly refilled", 2500 * time.Millisecond, Result{Allowed: true, Limit: 5, Remaining: 2, ResetAfter: 2500 * time.Millisecond}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allowed(epoch, epoch.Add(tt.tat), limit); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDenied(t *testing.T) {
+	limit := Limit{Rate: 1, Burst: 5}
+	tests := []struct {
+		name string
+		tat  time.Duration // since now
+		want Result
+	}{
+		{"bucket empty", 5 * time.Second, Result{Limit: 5, ResetAfter: 5 * time.Second, RetryAfter: time.Second}},
+		{"mid-interval", 5500 * time.Millisecond, Result{Limit: 5, ResetAfter: 5500 * time.Millisecond, RetryAfter: 1500 * time.Millisecond}},
+		{"refilled since", 3 * time.Second, Result{Limit: 5, ResetAfter: 3 * time.Second}},
+		{"full since", -time.Second, Result{Limit: 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := denied(epoch, epoch.Add(tt.tat), limit); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// testStore checks that store enforces a burst per key. The limit refills
+// slowly enough that no request is earned back during the test.
+func testStore(t *testing.T, store LimiterStore) {
+	t.Helper()
+	ctx := context.Background()
+	limit := Limit{Rate: 0.01, Burst: 3}
+	key := t.Name() + ":" + time.Now().Format(time.RFC3339Nano)
+
+	for i := range limit.Burst {
+		res, err := store.Allow(ctx, key, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Allowed || res.Limit != limit.Burst || res.Remaining != limit.Burst-1-i {
+			t.Fatalf("request %d: got %+v, want allowed with %d remaining", i, res, limit.Burst-1-i)
+		}
+		if res.RetryAfter != 0 {
+			t.Fatalf("request %d: got RetryAfter %s on an allowed request", i, res.RetryAfter)
+		}
+	}
+
+	res, err := store.Allow(ctx, key, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Allowed || res.Remaining != 0 {
+		t.Fatalf("request past the burst: got %+v, want denied", res)
+	}
+	if interval := limit.interval(); res.RetryAfter <= 0 || res.RetryAfter > interval {
+		t.Errorf("got RetryAfter %s, want within (0, %s]", res.RetryAfter, interval)
+	}
+
+	res, err = store.Allow(ctx, key+":other", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Allowed {
+		t.Errorf("another key: got %+v, want allowed", res)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
@@ -0,0 +1,27 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRedisStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	store, err := NewRedisStore("redis://" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go store.Run(ctx)
+
+	testStore(t, store)
+
+	for _, key := range server.Keys() {
+		if ttl := server.TTL(key); ttl <= 0 {
+			t.Errorf("key %s has no expiry", key)
+		}
+	}
+}